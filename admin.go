@@ -0,0 +1,210 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// SessionStatus is a snapshot of the state of an active session, as returned
+// by Server.SessionStatus().
+type SessionStatus struct {
+	SID string
+
+	// BackChannel is set while a back channel is open. Transport is its type
+	// ("xmlhttp", "html", "eventsource" or "websocket") and BufferedProxy is
+	// set for long polling (CI=1) back channels.
+	BackChannel   bool
+	Transport     string
+	BufferedProxy bool
+
+	// BackChannelBytes is the number of non-ACKed bytes on the back channel
+	// and PendingMessages the number of messages in the back channel queue.
+	BackChannelBytes int
+	PendingMessages  int
+
+	// SessionInfo holds the current forward and back channel AIDs.
+	SessionInfo SessionInfo
+
+	LastForwardChannel time.Time
+	LastBackChannel    time.Time
+
+	// Terminating is set while the session waits for the client to ACK a
+	// ServerTerminate stop message.
+	Terminating bool
+
+	// NoopAt, BackChannelCloseAt, IdleTimeoutAt and StopTimeoutAt are when
+	// the session's timers fire (the zero time when not running).
+	NoopAt             time.Time
+	BackChannelCloseAt time.Time
+	IdleTimeoutAt      time.Time
+	StopTimeoutAt      time.Time
+
+	// Topics are the topics the session is subscribed to (see Publish).
+	Topics []string
+
+	// Debug holds the session's recent debug messages, oldest first (see
+	// Options.DebugHistory).
+	Debug []DebugMessage
+}
+
+// adminRequest runs f on the session worker, unless ctx is done first.
+type adminRequest struct {
+	ctx  context.Context
+	f    func(sw *sessionWrapper)
+	done chan struct{}
+}
+
+// admin runs f on the worker of session sid and waits for it to complete.
+// If ctx is done before the worker reaches the request, f is skipped and the
+// error of ctx is returned. Once f has started it runs to completion, even if
+// admin has already returned the error of ctx.
+func (s *Server) admin(
+	ctx context.Context,
+	sid string,
+	f func(sw *sessionWrapper),
+) error {
+	sw, ok := s.sessions.get(sid)
+	if !ok {
+		return ErrUnknownSID
+	}
+	ar := &adminRequest{ctx: ctx, f: f, done: make(chan struct{})}
+	select {
+	case sw.adminNotifier <- ar:
+	case <-sw.done:
+		return ErrUnknownSID
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ar.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SessionIDs returns the sorted IDs of the sessions active on the Server.
+func (s *Server) SessionIDs() []string {
+	sessions := s.sessions.all()
+	sids := make([]string, 0, len(sessions))
+	for _, sw := range sessions {
+		sids = append(sids, sw.SID())
+	}
+	sort.Strings(sids)
+	return sids
+}
+
+// SessionStatus returns the status of the active session sid. The status is
+// read by the session's goroutine, so SessionStatus waits for any request
+// the session is currently processing. ErrUnknownSID is returned if sid is
+// not active on this Server.
+func (s *Server) SessionStatus(
+	ctx context.Context,
+	sid string,
+) (*SessionStatus, error) {
+	var status *SessionStatus
+	var err error
+	aerr := s.admin(ctx, sid, func(sw *sessionWrapper) {
+		status, err = sessionStatus(sw)
+	})
+	if aerr != nil {
+		return nil, aerr
+	}
+	return status, err
+}
+
+// Sessions returns the status of every active session, ordered by SID.
+// Sessions which terminate while the statuses are collected are omitted.
+func (s *Server) Sessions(ctx context.Context) ([]*SessionStatus, error) {
+	statuses := []*SessionStatus{}
+	for _, sid := range s.SessionIDs() {
+		status, err := s.SessionStatus(ctx, sid)
+		if err == ErrUnknownSID {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// TerminateSession immediately terminates the session sid with
+// ServerTerminateRequest. Unlike sending ServerTerminate to the session
+// Notifier(), it does not wait for a back channel to deliver the stop
+// message; stop is only delivered if a back channel is open.
+func (s *Server) TerminateSession(ctx context.Context, sid string) error {
+	return s.admin(ctx, sid, forceTerminate)
+}
+
+// CloseBackChannel closes the open back channel of session sid (if any),
+// prompting the client to open a new one.
+func (s *Server) CloseBackChannel(ctx context.Context, sid string) error {
+	return s.admin(ctx, sid, closeBackChannel)
+}
+
+// sessionStatus is invoked from sessionWorker.
+func sessionStatus(sw *sessionWrapper) (*SessionStatus, error) {
+	msgs, err := sw.BackChannelPeek()
+	if err != nil {
+		return nil, err
+	}
+	status := &SessionStatus{
+		SID:                sw.SID(),
+		BackChannel:        sw.bc != nil,
+		BackChannelBytes:   sw.backChannelBytes,
+		PendingMessages:    len(msgs),
+		SessionInfo:        *sw.si,
+		LastForwardChannel: sw.lastForwardChannel,
+		LastBackChannel:    sw.lastBackChannel,
+		Terminating:        sw.stopID >= 0,
+		NoopAt:             sw.noopTimer.due(),
+		BackChannelCloseAt: sw.longBackChannelTimer.due(),
+		IdleTimeoutAt:      sw.idleTimer.due(),
+		StopTimeoutAt:      sw.stopTimer.due(),
+		Topics:             []string{},
+		Debug:              sw.debugLog.messages(),
+	}
+	if sw.bc != nil {
+		status.LastBackChannel = time.Now()
+		status.BufferedProxy = sw.p.buffered
+		switch {
+		case sw.bc.webSocket:
+			status.Transport = "websocket"
+		default:
+			status.Transport = sw.bc.r.FormValue("TYPE")
+		}
+	}
+
+	sw.srv.topicMutex.RLock()
+	for topic := range sw.topics {
+		status.Topics = append(status.Topics, topic)
+	}
+	sw.srv.topicMutex.RUnlock()
+	sort.Strings(status.Topics)
+	return status, nil
+}
+
+// forceTerminate is invoked from sessionWorker.
+func forceTerminate(sw *sessionWrapper) {
+	sw.debug(sw.request(), "wc: admin terminate session")
+	stopSession(sw, ServerTerminateRequest, 0)
+}
+
+// closeBackChannel is invoked from sessionWorker.
+func closeBackChannel(sw *sessionWrapper) {
+	if sw.bc == nil {
+		return
+	}
+	sw.debug(sw.request(), "wc: admin close back channel")
+	sw.p.end()
+	sw.BackChannelClose()
+	close(sw.bc.done)
+	sw.clearBackChannel()
+}
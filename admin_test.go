@@ -0,0 +1,123 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionAdmin(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer(&testSessionManager{}, nil)
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/bind", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.BackChannelAdd([]byte(`["a"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Subscribe(sw.SID(), "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.SessionIDs(); !reflect.DeepEqual(got, []string{sw.SID()}) {
+		t.Errorf("SessionIDs = %v, want [%s]", got, sw.SID())
+	}
+	status, err := srv.SessionStatus(ctx, sw.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SessionStatus{
+		SID:                sw.SID(),
+		PendingMessages:    1,
+		SessionInfo:        SessionInfo{-1, -1},
+		LastForwardChannel: status.LastForwardChannel,
+		LastBackChannel:    status.LastBackChannel,
+		Topics:             []string{"room"},
+		Debug:              []DebugMessage{},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("SessionStatus = %+v, want %+v", status, want)
+	}
+
+	if err := srv.CloseBackChannel(ctx, sw.SID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.TerminateSession(ctx, sw.SID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.SessionStatus(ctx, sw.SID()); err != ErrUnknownSID {
+		t.Errorf("SessionStatus after terminate = %v, want ErrUnknownSID", err)
+	}
+	statuses, err := srv.Sessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("Sessions = %v, want none", statuses)
+	}
+	if len(srv.topics) != 0 {
+		t.Errorf("topics = %v, want none", srv.topics)
+	}
+}
+
+func TestTerminateSessionStop(t *testing.T) {
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	srv, url := newTestServer(t, sm, nil)
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	body := openBackChannel(ctx, t, srv, url, "1")
+	if err := sm.session("1").Send([]byte(`"a"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stop is queued after "a", rather than written with ID 0.
+	if err := srv.TerminateSession(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if reason := <-sm.terminated; reason != ServerTerminateRequest {
+		t.Errorf("TerminatedSession reason = %v, want ServerTerminateRequest",
+			reason)
+	}
+	if b := <-body; !strings.Contains(b, `[2,["stop"]]`) {
+		t.Errorf("back channel %q, want stop with ID 2", b)
+	}
+}
+
+func TestAdminCanceled(t *testing.T) {
+	srv := NewServer(&testSessionManager{}, nil)
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/bind", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request whose context is done by the time the worker receives it is
+	// skipped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	ar := &adminRequest{
+		ctx:  ctx,
+		f:    func(sw *sessionWrapper) { ran = true },
+		done: make(chan struct{}),
+	}
+	sw.adminNotifier <- ar
+	<-ar.done
+	if ran {
+		t.Error("admin function ran after its context was canceled")
+	}
+	if _, err := srv.SessionStatus(context.Background(), sw.SID()); err != nil {
+		t.Errorf("SessionStatus = %v", err)
+	}
+}
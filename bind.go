@@ -5,7 +5,6 @@
 package wc
 
 import (
-	"fmt"
 	"net/http"
 )
 
@@ -24,90 +23,104 @@ import (
 // Tasks for application level:
 // * sharding comet server? (moving sessions across servers?)
 // * restart server without dropping back channels
-// * expvar stats: # sessions, # backchannels, # pending messages, etc
 
 type reqRegister struct {
 	w    http.ResponseWriter
 	r    *http.Request
 	done chan struct{}
+	// webSocket is set for requests from WebSocketHandler, and ws once the
+	// request has been upgraded.
+	webSocket bool
+	ws        *wsConn
 }
 
 func newReqRegister(w http.ResponseWriter, r *http.Request) *reqRegister {
-	return &reqRegister{w, r, make(chan struct{})}
+	return &reqRegister{w: w, r: r, done: make(chan struct{})}
 }
 
-func init() {
-	sessionWrapperMap = make(map[string]*sessionWrapper)
-}
-
-func debug(format string, a ...interface{}) {
-	sm.Debug(fmt.Sprintf(format, a...))
-}
-
-func newSession(r *http.Request) (*sessionWrapper, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	session, err := sm.NewSession(r)
+func (s *Server) newSession(r *http.Request) (*sessionWrapper, error) {
+	if s.shuttingDown.Load() {
+		return nil, ErrServerShutdown
+	}
+	session, err := s.sm.NewSession(r)
 	if err != nil {
 		return nil, err
 	}
 
-	sw := newSessionWrapper(session)
-	launchSession(sw)
-
-	sessionWrapperMap[session.SID()] = sw
-	return sw, nil
-}
-
-func getSession(r *http.Request) (*sessionWrapper, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	sid := r.FormValue("SID")
-	if sw, hasSession := sessionWrapperMap[sid]; hasSession {
-		return sw, nil
-	}
-	session, si, err := sm.LookupSession(r, sid)
-	if err != nil {
+	sw := newSessionWrapper(s, session)
+	if err := s.add(sw); err != nil {
 		return nil, err
 	}
-
-	sw := newSessionWrapper(session)
-	sw.si = si
-	launchSession(sw)
-
-	sessionWrapperMap[sid] = sw
 	return sw, nil
 }
 
-// BindHandler handles forward and backward channel HTTP requests. When using
-// the defaults this handler should be installed at "/channel" (WebChannel) or
-// "/channel/bind" (BrowserChannel).
-func BindHandler(w http.ResponseWriter, r *http.Request) {
-	if sm == nil {
-		panic("No SessionManager provided")
-	}
+func (s *Server) getSession(r *http.Request) (*sessionWrapper, error) {
+	return s.lookup(r, r.FormValue("SID"))
+}
+
+// session returns the session for r, creating it if necessary. On failure
+// an HTTP error is written and nil is returned.
+func (s *Server) session(
+	w http.ResponseWriter,
+	r *http.Request,
+) *sessionWrapper {
 	var sw *sessionWrapper
 	var err error
 	switch {
 	case r.FormValue("SID") == "":
-		sw, err = newSession(r)
+		sw, err = s.newSession(r)
 	default:
-		sw, err = getSession(r)
+		sw, err = s.getSession(r)
 	}
 	if err != nil {
-		sm.Error(r, err)
+		s.sm.Error(r, err)
 		switch {
 		case err == ErrUnknownSID:
 			// Special case 'Unknown SID' to be compatible with JS impl. See
 			// goog.labs.net.webChannel.ChannelRequest#onXmlHttpReadyStateChanged_
 			// for more details.
+			s.metric(MetricUnknownSID, 1)
 			http.Error(w, ErrUnknownSID.Error(), 400)
+		case err == ErrServerShutdown:
+			http.Error(w, ErrServerShutdown.Error(),
+				http.StatusServiceUnavailable)
 		default:
 			http.Error(w, "Unable to locate SID", http.StatusInternalServerError)
 		}
+		return nil
+	}
+	return sw
+}
+
+// dispatch passes rr to the worker of sw. If the session has already been
+// terminated 'Unknown SID' is written and false is returned.
+func (s *Server) dispatch(sw *sessionWrapper, rr *reqRegister) bool {
+	select {
+	case sw.reqNotifier <- rr:
+		return true
+	case <-sw.done:
+		s.metric(MetricUnknownSID, 1)
+		http.Error(rr.w, ErrUnknownSID.Error(), 400)
+		return false
+	}
+}
+
+// BindHandler handles forward and backward channel HTTP requests. When using
+// the defaults this handler should be installed at "/channel" (WebChannel) or
+// "/channel/bind" (BrowserChannel).
+//
+// Back channel requests with TYPE=eventsource are streamed as
+// text/event-stream, suitable for a native EventSource. On reconnect the
+// Last-Event-ID header is used as the AID when it is newer than the AID
+// query parameter.
+func (s *Server) BindHandler(w http.ResponseWriter, r *http.Request) {
+	sw := s.session(w, r)
+	if sw == nil {
 		return
 	}
 	rr := newReqRegister(w, r)
-	sw.reqNotifier <- rr
+	if !s.dispatch(sw, rr) {
+		return
+	}
 	<-rr.done
 }
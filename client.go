@@ -0,0 +1,568 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0/internal/wire"
+)
+
+// ErrClientClosed is returned by Client methods once Close() has been called.
+var ErrClientClosed = errors.New("wc: Client closed")
+
+const (
+	defaultClientReconnectDelay = time.Second
+	maxClientReconnectDelay     = 30 * time.Second
+)
+
+// ClientOptions configures a Client. The zero value provides the defaults.
+type ClientOptions struct {
+	// HTTPClient is used for all requests. The default is http.DefaultClient.
+	// It must not have a Timeout, which would limit back channels.
+	HTTPClient *http.Client
+
+	// Header is added to every request (for example authentication cookies).
+	Header http.Header
+
+	// TestPath and BindPath are the paths of TestHandler and BindHandler
+	// relative to the URL passed to Dial. The defaults are "test" and "bind".
+	TestPath string
+	BindPath string
+
+	// SkipTest skips the test phases, which determine the host prefix and
+	// whether a buffering proxy requires long polling back channels (CI=1).
+	SkipTest bool
+
+	// BufferedProxy forces long polling back channels. It is also set when
+	// the test phases detect a buffering proxy.
+	BufferedProxy bool
+
+	// ReconnectDelay is the initial delay before reopening a back channel
+	// which failed. It doubles with each consecutive failure, to at most 30
+	// seconds. The default is 1 second.
+	ReconnectDelay time.Duration
+}
+
+// Client is a Go implementation of the client side of the WebChannel
+// (BrowserChannel version 8) protocol, as served by Server.TestHandler and
+// Server.BindHandler. It is suitable for integration tests, bots and other
+// non-browser clients.
+//
+// Forward channel messages are maps of strings, as with goog.net.WebChannel.
+// Back channel messages are returned as Messages holding the raw JSON of each
+// message. The back channel is reopened automatically (with the AID of the
+// last received message) whenever the server closes it.
+type Client struct {
+	hc            *http.Client
+	header        http.Header
+	testURL       string
+	bindURL       string
+	bufferedProxy bool
+	delay         time.Duration
+
+	sid        string
+	hostPrefix string
+
+	// mutex guards aid, the ID of the last received back channel message,
+	// rid, the ID of the last request, and stats.
+	mutex sync.Mutex
+	aid   int
+	rid   int
+	stats ClientStats
+
+	// sendMutex serializes forward channel requests. pending holds the maps
+	// not yet ACKed by the server, the first of which has ID nextID.
+	sendMutex sync.Mutex
+	pending   []map[string]string
+	nextID    int
+
+	msgs      chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	// err is the reason the back channel stopped, valid once stopped is
+	// closed.
+	err     error
+	stopped chan struct{}
+}
+
+// Dial creates a WebChannel session with the server at rawurl (the URL under
+// which TestHandler and BindHandler are installed, such as
+// http://host/channel) and opens its back channel. ctx limits the handshake.
+func Dial(ctx context.Context, rawurl string, opts *ClientOptions) (
+	*Client,
+	error,
+) {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
+	base, err := url.Parse(strings.TrimSuffix(rawurl, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	ref := func(path, def string) string {
+		if path == "" {
+			path = def
+		}
+		return base.ResolveReference(&url.URL{Path: path}).String()
+	}
+	c := &Client{
+		hc:            opts.HTTPClient,
+		header:        opts.Header,
+		testURL:       ref(opts.TestPath, "test"),
+		bindURL:       ref(opts.BindPath, "bind"),
+		bufferedProxy: opts.BufferedProxy,
+		delay:         opts.ReconnectDelay,
+		aid:           -1,
+		msgs:          make(chan *Message),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if c.hc == nil {
+		c.hc = http.DefaultClient
+	}
+	if c.delay <= 0 {
+		c.delay = defaultClientReconnectDelay
+	}
+
+	if !opts.SkipTest {
+		if err := c.test(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.create(ctx); err != nil {
+		return nil, err
+	}
+
+	bcCtx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.backChannelLoop(bcCtx)
+	return c, nil
+}
+
+// SID returns the session ID.
+func (c *Client) SID() string {
+	return c.sid
+}
+
+// HostPrefix returns the host prefix reported by the server's test phase.
+func (c *Client) HostPrefix() string {
+	return c.hostPrefix
+}
+
+// BufferedProxy reports whether the back channel uses long polling.
+func (c *Client) BufferedProxy() bool {
+	return c.bufferedProxy
+}
+
+// ClientStats counts the back channel activity of a Client.
+type ClientStats struct {
+	// BackChannels is the number of back channel requests made, including
+	// those which failed.
+	BackChannels int
+	// Failures is the number of back channel requests which failed (rather
+	// than being closed by the server).
+	Failures int
+	// Messages and Noops are the number of messages and noop messages
+	// received.
+	Messages int
+	Noops    int
+}
+
+// Stats returns the back channel activity so far.
+func (c *Client) Stats() ClientStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// request creates a request to rawurl with the common and additional query
+// parameters.
+func (c *Client) request(
+	ctx context.Context,
+	method string,
+	rawurl string,
+	query url.Values,
+	body io.Reader,
+) (*http.Request, error) {
+	query.Set("VER", "8")
+	query.Set("zx", strconv.FormatInt(time.Now().UnixNano(), 36))
+	r, err := http.NewRequestWithContext(ctx, method,
+		rawurl+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.header {
+		r.Header[key] = values
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r, nil
+}
+
+func (c *Client) do(r *http.Request) (*http.Response, error) {
+	resp, err := c.hc.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == 400 &&
+			strings.TrimSpace(string(b)) == ErrUnknownSID.Error() {
+			return nil, ErrUnknownSID
+		}
+		return nil, fmt.Errorf("wc: %s returned %s: %s", r.URL.Path,
+			resp.Status, bytes.TrimSpace(b))
+	}
+	return resp, nil
+}
+
+// nextRID returns the ID of the next forward channel request.
+func (c *Client) nextRID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rid++
+	return strconv.Itoa(c.rid)
+}
+
+// test runs both test phases.
+func (c *Client) test(ctx context.Context) error {
+	r, err := c.request(ctx, "GET", c.testURL, url.Values{"MODE": {"init"}},
+		nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	var init []*string
+	err = json.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("wc: unable to parse test response: %v", err)
+	}
+	if len(init) > 0 && init[0] != nil {
+		c.hostPrefix = *init[0]
+	}
+
+	// The server writes the first chunk immediately and the second after a
+	// delay. If both arrive together the response was buffered.
+	testCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r, err = c.request(testCtx, "GET", c.testURL,
+		url.Values{"TYPE": {"xmlhttp"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err = c.do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	chunk := make([]byte, len(testFirstChunk))
+	if _, err := io.ReadFull(br, chunk); err != nil {
+		return fmt.Errorf("wc: unable to read test response: %v", err)
+	}
+	if string(chunk) != testFirstChunk {
+		return fmt.Errorf("wc: unexpected test response %q", chunk)
+	}
+	if br.Buffered() > 0 {
+		c.bufferedProxy = true
+	}
+	return nil
+}
+
+// create establishes the session.
+func (c *Client) create(ctx context.Context) error {
+	query := url.Values{"RID": {c.nextRID()}, "CVER": {"8"}}
+	r, err := c.request(ctx, "POST", c.bindURL, query,
+		strings.NewReader("count=0"))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	chunk, err := readLengthChunk(bufio.NewReader(resp.Body))
+	if err != nil {
+		return err
+	}
+	msgs, err := decodeMessages(chunk)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		var create []interface{}
+		if json.Unmarshal(msg.Body, &create) == nil && len(create) >= 2 &&
+			create[0] == "c" {
+			sid, _ := create[1].(string)
+			c.sid = sid
+			c.aid = msg.ID
+			// Messages following the create message are left to the back
+			// channel, since they have not been ACKed.
+			break
+		}
+	}
+	if c.sid == "" {
+		return errors.New("wc: no create message in session response")
+	}
+	return nil
+}
+
+// Send delivers msgs on the forward channel, returning once the server has
+// ACKed them. Messages which could not be delivered are retried by the next
+// call to Send.
+func (c *Client) Send(ctx context.Context, msgs ...map[string]string) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	c.pending = append(c.pending, msgs...)
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	form := url.Values{
+		"count": {strconv.Itoa(len(c.pending))},
+		"ofs":   {strconv.Itoa(c.nextID)},
+	}
+	for i, msg := range c.pending {
+		for key, value := range msg {
+			form.Set(fmt.Sprintf("req%d_%s", i, key), value)
+		}
+	}
+	c.mutex.Lock()
+	aid := c.aid
+	c.mutex.Unlock()
+	query := url.Values{
+		"SID": {c.sid},
+		"RID": {c.nextRID()},
+		"AID": {strconv.Itoa(aid)},
+	}
+	r, err := c.request(ctx, "POST", c.bindURL, query,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := readLengthChunk(bufio.NewReader(resp.Body)); err != nil {
+		return err
+	}
+	c.nextID += len(c.pending)
+	c.pending = nil
+	return nil
+}
+
+// Receive returns the next back channel message. noop messages are not
+// returned. ErrSessionTerminated is returned once the server has terminated
+// the session, and ErrClientClosed once Close() has been called.
+func (c *Client) Receive(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-c.msgs:
+		return msg, nil
+	case <-c.stopped:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close terminates the session (unless the server already has) and stops
+// the back channel.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+		<-c.stopped
+		if c.err != ErrClientClosed {
+			// The session has already ended.
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var r *http.Request
+		r, err = c.request(ctx, "GET", c.bindURL, url.Values{
+			"SID":  {c.sid},
+			"RID":  {c.nextRID()},
+			"TYPE": {"terminate"},
+		}, nil)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = c.do(r)
+		if err == nil {
+			resp.Body.Close()
+		}
+	})
+	return err
+}
+
+// backChannelLoop keeps a back channel open until the session ends.
+func (c *Client) backChannelLoop(ctx context.Context) {
+	defer close(c.stopped)
+	delay := c.delay
+	for {
+		c.mutex.Lock()
+		c.stats.BackChannels++
+		c.mutex.Unlock()
+		err := c.backChannel(ctx)
+		if err != nil && err != ErrSessionTerminated && ctx.Err() == nil {
+			c.mutex.Lock()
+			c.stats.Failures++
+			c.mutex.Unlock()
+		}
+		select {
+		case <-c.done:
+			c.err = ErrClientClosed
+			return
+		default:
+		}
+		switch {
+		case err == nil:
+			// The server closed the back channel; reopen it.
+			delay = c.delay
+			continue
+		case err == ErrUnknownSID || err == ErrSessionTerminated:
+			c.err = err
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			c.err = ErrClientClosed
+			return
+		}
+		if delay *= 2; delay > maxClientReconnectDelay {
+			delay = maxClientReconnectDelay
+		}
+	}
+}
+
+// backChannel opens a single back channel and delivers its messages.
+func (c *Client) backChannel(ctx context.Context) error {
+	c.mutex.Lock()
+	aid := c.aid
+	c.mutex.Unlock()
+	query := url.Values{
+		"SID":  {c.sid},
+		"RID":  {"rpc"},
+		"AID":  {strconv.Itoa(aid)},
+		"TYPE": {"xmlhttp"},
+		"CI":   {"0"},
+	}
+	if c.bufferedProxy {
+		query.Set("CI", "1")
+	}
+	r, err := c.request(ctx, "GET", c.bindURL, query, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	for {
+		chunk, err := readLengthChunk(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := decodeMessages(chunk)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := c.deliver(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deliver processes a back channel message.
+func (c *Client) deliver(msg *Message) error {
+	c.mutex.Lock()
+	if msg.ID <= c.aid {
+		// Already received on a previous back channel.
+		c.mutex.Unlock()
+		return nil
+	}
+	c.aid = msg.ID
+	body := string(msg.Body)
+	switch body {
+	case `["noop"]`:
+		c.stats.Noops++
+	case `["stop"]`:
+	default:
+		c.stats.Messages++
+	}
+	c.mutex.Unlock()
+
+	switch body {
+	case `["noop"]`:
+		return nil
+	case `["stop"]`:
+		// The server terminates the session once the stop has been written
+		// to the back channel, so it is not ACKed.
+		return ErrSessionTerminated
+	}
+	select {
+	case c.msgs <- msg:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	}
+}
+
+// readLengthChunk reads a single length prefixed chunk of a back channel or
+// forward channel response.
+func readLengthChunk(br *bufio.Reader) ([]byte, error) {
+	return wire.ReadChunk(br)
+}
+
+// decodeMessages parses a back channel chunk.
+func decodeMessages(chunk []byte) ([]*Message, error) {
+	decoded, err := wire.DecodeMessages(chunk)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(decoded))
+	for _, msg := range decoded {
+		msgs = append(msgs, NewMessage(msg.ID, msg.Body))
+	}
+	return msgs, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClientTestServer serves echoing sessions with host prefix "prefix".
+func newClientTestServer(t *testing.T) (
+	*Server,
+	*testSessionManager,
+	string,
+) {
+	sm := &testSessionManager{
+		forward:    echo,
+		hostPrefix: "prefix",
+		terminated: make(chan TerminationReason, 1),
+	}
+	srv, url := newTestServer(t, sm, nil)
+	return srv, sm, url
+}
+
+func TestClientEcho(t *testing.T) {
+	_, sm, url := newClientTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SID() != "1" || c.HostPrefix() != "prefix" || c.BufferedProxy() {
+		t.Errorf("Dial = %q %q %v, want 1 prefix false", c.SID(),
+			c.HostPrefix(), c.BufferedProxy())
+	}
+
+	if err := c.Send(ctx, map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(ctx, map[string]string{"b": "\U0001F600"}); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(msg.Body)] = true
+	}
+	for _, want := range []string{`{"a":"1"}`, "{\"b\":\"\U0001F600\"}"} {
+		if !got[want] {
+			t.Errorf("Receive = %v, want %s", got, want)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.BackChannels != 1 || stats.Failures != 0 || stats.Messages != 2 {
+		t.Errorf("Stats = %+v, want 1 back channel and 2 messages", stats)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := <-sm.terminated; reason != ClientTerminateRequest {
+		t.Errorf("TerminatedSession reason = %v, want ClientTerminateRequest",
+			reason)
+	}
+	if err := c.Send(ctx, map[string]string{"a": "1"}); err != ErrClientClosed {
+		t.Errorf("Send after Close = %v, want ErrClientClosed", err)
+	}
+}
+
+func TestClientServerTerminate(t *testing.T) {
+	srv, sm, url := newClientTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url,
+		&ClientOptions{SkipTest: true, BufferedProxy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Long polling back channels are reopened after each message.
+	for _, body := range []string{"x", "y"} {
+		if err := c.Send(ctx, map[string]string{"k": body}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"k":"` + body + `"}`; string(msg.Body) != want {
+			t.Errorf("Receive = %s, want %s", msg.Body, want)
+		}
+	}
+
+	// Wait for the back channel to be reopened, so it receives the stop
+	// message.
+	for {
+		status, err := srv.SessionStatus(ctx, c.SID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.BackChannel {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := srv.TerminateSession(ctx, c.SID()); err != nil {
+		t.Fatal(err)
+	}
+	<-sm.terminated
+	if _, err := c.Receive(ctx); err != ErrSessionTerminated {
+		t.Errorf("Receive = %v, want ErrSessionTerminated", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
+
+func TestClientDeliverStop(t *testing.T) {
+	c := &Client{aid: 3}
+	// A stop which was already received is ignored, like any other message.
+	if err := c.deliver(NewMessage(2, []byte(`["stop"]`))); err != nil {
+		t.Errorf("deliver of received stop = %v, want nil", err)
+	}
+	err := c.deliver(NewMessage(4, []byte(`["stop"]`)))
+	if err != ErrSessionTerminated {
+		t.Errorf("deliver of stop = %v, want ErrSessionTerminated", err)
+	}
+	if c.aid != 4 {
+		t.Errorf("aid = %d after stop, want 4", c.aid)
+	}
+	if stats := c.Stats(); stats != (ClientStats{}) {
+		t.Errorf("Stats = %+v, want none", stats)
+	}
+}
+
+func TestReadLengthChunk(t *testing.T) {
+	// U+1F600 is 2 UTF-16 code units.
+	br := bufio.NewReader(strings.NewReader("3\n[1]4\n\"\U0001F600\"3\n[]"))
+	for _, want := range []string{`[1]`, `"` + "\U0001F600" + `"`} {
+		chunk, err := readLengthChunk(br)
+		if err != nil || string(chunk) != want {
+			t.Errorf("readLengthChunk = %q %v, want %q", chunk, err, want)
+		}
+	}
+	if chunk, err := readLengthChunk(br); err == nil {
+		t.Errorf("readLengthChunk = %q, want error", chunk)
+	}
+}
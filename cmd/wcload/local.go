@@ -0,0 +1,48 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0"
+	"gopkg.in/samegoal/wc.v0/wctest"
+)
+
+// localServer is an in-process echo server on a loopback port.
+type localServer struct {
+	url string
+	wc  *wc.Server
+	hs  *http.Server
+}
+
+func startLocal(noop time.Duration) (*localServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := wc.NewServer(&wctest.EchoSessionManager{},
+		&wc.Options{NoopInterval: noop})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channel/test", srv.TestHandler)
+	mux.HandleFunc("/channel/bind", srv.BindHandler)
+	l := &localServer{
+		url: "http://" + ln.Addr().String() + "/channel",
+		wc:  srv,
+		hs:  &http.Server{Handler: mux},
+	}
+	go l.hs.Serve(ln)
+	return l, nil
+}
+
+func (l *localServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	l.wc.Shutdown(ctx)
+	l.hs.Close()
+}
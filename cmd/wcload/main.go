@@ -0,0 +1,318 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command wcload simulates many WebChannel clients against a local wc
+// endpoint, to measure how many concurrent sessions a server can hold.
+//
+// Each client creates a session, holds a streaming back channel and sends
+// forward channel messages at -rate per second, which the server is expected
+// to echo on the back channel (as the -local server does). When -duration
+// has elapsed the sessions are terminated and wcload reports connect
+// latency, message round trip percentiles, noop overhead, errors and back
+// channel reconnects.
+//
+// Usage:
+//
+//	wcload -local -clients 1000 -duration 30s
+//	wcload -url http://localhost:8080/channel -clients 5000 -rate 0.2
+//
+// Only loopback targets are accepted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0"
+)
+
+type config struct {
+	url         string
+	local       bool
+	clients     int
+	rate        float64
+	duration    time.Duration
+	connectRate float64
+	noop        time.Duration
+	test        bool
+}
+
+func main() {
+	cfg := config{}
+	flag.StringVar(&cfg.url, "url", "",
+		"channel URL (under which TestHandler and BindHandler are installed)")
+	flag.BoolVar(&cfg.local, "local", false,
+		"start an in-process echo server as the target")
+	flag.IntVar(&cfg.clients, "clients", 100, "number of simulated clients")
+	flag.Float64Var(&cfg.rate, "rate", 1,
+		"forward channel messages per second per client")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second,
+		"length of the run")
+	flag.Float64Var(&cfg.connectRate, "connect-rate", 200,
+		"new clients per second while ramping up")
+	flag.DurationVar(&cfg.noop, "noop", 0,
+		"noop interval of the -local server (0 for the wc default)")
+	flag.BoolVar(&cfg.test, "test", false,
+		"run the test phases before creating each session")
+	flag.Parse()
+
+	if err := run(cfg, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run performs a load test and writes the report to out.
+func run(cfg config, out io.Writer) error {
+	if cfg.clients <= 0 || !(cfg.rate >= 0) || !(cfg.connectRate > 0) {
+		return errors.New(
+			"wcload: -clients and -connect-rate must be positive and -rate " +
+				"must not be negative")
+	}
+	// Rates so large that the interval truncates to zero would panic the
+	// ticker and the send timer.
+	if (cfg.rate > 0 && interval(cfg.rate) < 1) ||
+		interval(cfg.connectRate) < 1 {
+		return errors.New(
+			"wcload: -rate and -connect-rate must be at most 1e9 per second")
+	}
+	target := cfg.url
+	if cfg.local {
+		local, err := startLocal(cfg.noop)
+		if err != nil {
+			return err
+		}
+		defer local.close()
+		target = local.url
+	}
+	if err := checkLocal(target); err != nil {
+		return err
+	}
+
+	l := &load{
+		cfg:    cfg,
+		target: target,
+		hc: &http.Client{Transport: &http.Transport{
+			// Forward channel requests reuse connections rather than each
+			// client churning through ephemeral ports.
+			MaxIdleConnsPerHost: cfg.clients,
+		}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+
+	start := time.Now()
+	ramp := time.NewTicker(interval(cfg.connectRate))
+	defer ramp.Stop()
+	var wg sync.WaitGroup
+launch:
+	for i := 0; i < cfg.clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			l.client(ctx, id)
+		}(i)
+		select {
+		case <-ramp.C:
+		case <-ctx.Done():
+			break launch
+		}
+	}
+	wg.Wait()
+	l.report(out, time.Since(start))
+	return nil
+}
+
+// checkLocal ensures rawurl refers to this machine.
+func checkLocal(rawurl string) error {
+	if rawurl == "" {
+		return errors.New("wcload: -url or -local is required")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("wcload: %s is not a loopback address", host)
+}
+
+// load holds the state and results of a run.
+type load struct {
+	cfg    config
+	target string
+	hc     *http.Client
+
+	mutex         sync.Mutex
+	connected     int
+	dialErrors    int
+	sendErrors    int
+	receiveErrors int
+	sent          int
+	received      int
+	connect       []time.Duration
+	roundTrip     []time.Duration
+	stats         wc.ClientStats
+}
+
+// client simulates a single client until ctx is done.
+func (l *load) client(ctx context.Context, id int) {
+	start := time.Now()
+	c, err := wc.Dial(ctx, l.target, &wc.ClientOptions{
+		HTTPClient: l.hc,
+		SkipTest:   !l.cfg.test,
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			l.mutex.Lock()
+			l.dialErrors++
+			l.mutex.Unlock()
+		}
+		return
+	}
+	l.mutex.Lock()
+	l.connected++
+	l.connect = append(l.connect, time.Since(start))
+	l.mutex.Unlock()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		l.receive(ctx, c)
+	}()
+	l.send(ctx, c, id)
+	<-received
+
+	stats := c.Stats()
+	c.Close()
+	l.mutex.Lock()
+	l.stats.BackChannels += stats.BackChannels
+	l.stats.Failures += stats.Failures
+	l.stats.Messages += stats.Messages
+	l.stats.Noops += stats.Noops
+	l.mutex.Unlock()
+}
+
+// interval returns the time between events occurring rate times per second.
+func interval(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// send sends timestamped messages at the configured rate.
+func (l *load) send(ctx context.Context, c *wc.Client, id int) {
+	if l.cfg.rate == 0 {
+		<-ctx.Done()
+		return
+	}
+	every := interval(l.cfg.rate)
+	// Spread the clients' sends across the interval.
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(every))))
+	defer timer.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		timer.Reset(every)
+		err := c.Send(ctx, map[string]string{
+			"c": strconv.Itoa(id),
+			"n": strconv.Itoa(n),
+			"t": strconv.FormatInt(time.Now().UnixNano(), 10),
+		})
+		l.mutex.Lock()
+		switch {
+		case err == nil:
+			l.sent++
+		case ctx.Err() == nil:
+			l.sendErrors++
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// receive measures the round trip of echoed messages.
+func (l *load) receive(ctx context.Context, c *wc.Client) {
+	for {
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				l.mutex.Lock()
+				l.receiveErrors++
+				l.mutex.Unlock()
+			}
+			return
+		}
+		var echo map[string]string
+		if json.Unmarshal(msg.Body, &echo) != nil {
+			continue
+		}
+		sent, err := strconv.ParseInt(echo["t"], 10, 64)
+		if err != nil {
+			continue
+		}
+		l.mutex.Lock()
+		l.received++
+		l.roundTrip = append(l.roundTrip, time.Since(time.Unix(0, sent)))
+		l.mutex.Unlock()
+	}
+}
+
+func (l *load) report(out io.Writer, elapsed time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintf(out, "target         %s (%s)\n", l.target,
+		elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "clients        %d connected, %d dial errors\n",
+		l.connected, l.dialErrors)
+	fmt.Fprintf(out, "connect        %s\n", percentiles(l.connect))
+	fmt.Fprintf(out, "messages       %d sent, %d received, %d send errors, "+
+		"%d receive errors\n", l.sent, l.received, l.sendErrors,
+		l.receiveErrors)
+	fmt.Fprintf(out, "round trip     %s\n", percentiles(l.roundTrip))
+	reconnects := l.stats.BackChannels - l.connected
+	if reconnects < 0 {
+		reconnects = 0
+	}
+	fmt.Fprintf(out, "back channels  %d opened, %d reconnects, %d failures\n",
+		l.stats.BackChannels, reconnects, l.stats.Failures)
+	overhead := 0.0
+	if total := l.stats.Noops + l.stats.Messages; total > 0 {
+		overhead = 100 * float64(l.stats.Noops) / float64(total)
+	}
+	fmt.Fprintf(out, "noops          %d (%.1f%% of back channel messages)\n",
+		l.stats.Noops, overhead)
+}
+
+// percentiles summarizes durations.
+func percentiles(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v  p90 %v  p99 %v  max %v", p(0.5), p(0.9),
+		p(0.99), sorted[len(sorted)-1].Round(time.Microsecond))
+}
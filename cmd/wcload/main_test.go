@@ -0,0 +1,70 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLocal(t *testing.T) {
+	var out bytes.Buffer
+	err := run(config{
+		local:       true,
+		clients:     5,
+		rate:        20,
+		duration:    time.Second,
+		connectRate: 100,
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"5 connected, 0 dial errors",
+		"0 send errors, 0 receive errors",
+		"5 opened, 0 reconnects, 0 failures",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCheckLocal(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://localhost:8080/channel", true},
+		{"http://127.0.0.1/channel", true},
+		{"http://[::1]:80/channel", true},
+		{"http://example.com/channel", false},
+		{"http://10.0.0.1/channel", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if err := checkLocal(test.url); (err == nil) != test.ok {
+			t.Errorf("checkLocal(%q) = %v, want ok %v", test.url, err, test.ok)
+		}
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	for _, cfg := range []config{
+		{clients: 0, rate: 1, connectRate: 1},
+		{clients: 1, rate: -1, connectRate: 1},
+		{clients: 1, rate: 1, connectRate: 0},
+		{clients: 1, rate: 2e9, connectRate: 1},
+		{clients: 1, rate: 1, connectRate: 2e9},
+	} {
+		cfg.local = true
+		if err := run(cfg, io.Discard); err == nil {
+			t.Errorf("run(%+v) succeeded", cfg)
+		}
+	}
+}
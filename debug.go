@@ -0,0 +1,198 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DebugMessage is a debug message recorded for a session.
+type DebugMessage struct {
+	Time    time.Time
+	Message string
+	Attrs   []slog.Attr
+}
+
+// debugRing retains the most recent len(recs) debug records (none when recs
+// is empty).
+type debugRing struct {
+	mutex sync.Mutex
+	recs  []slog.Record
+	next  int
+	full  bool
+}
+
+// enabled reports whether d retains any records.
+func (d *debugRing) enabled() bool {
+	return len(d.recs) > 0
+}
+
+func (d *debugRing) add(rec slog.Record) {
+	if !d.enabled() {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.recs[d.next] = rec
+	d.next = (d.next + 1) % len(d.recs)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// messages returns the retained messages, oldest first.
+func (d *debugRing) messages() []DebugMessage {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	recs := []slog.Record{}
+	if d.full {
+		recs = append(recs, d.recs[d.next:]...)
+	}
+	recs = append(recs, d.recs[:d.next]...)
+
+	msgs := make([]DebugMessage, 0, len(recs))
+	for _, rec := range recs {
+		msg := DebugMessage{Time: rec.Time, Message: rec.Message}
+		rec.Attrs(func(a slog.Attr) bool {
+			msg.Attrs = append(msg.Attrs, a)
+			return true
+		})
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// requestType describes r for logging.
+func requestType(r *http.Request) string {
+	switch {
+	case isWebSocketRequest(r):
+		return "websocket"
+	case r.FormValue("TYPE") != "":
+		return r.FormValue("TYPE")
+	case r.FormValue("SID") == "":
+		return "new"
+	}
+	return "forward"
+}
+
+// bodyAttr logs a JSON message body.
+func bodyAttr(body []byte) slog.Attr {
+	return slog.Any("body", json.RawMessage(body))
+}
+
+var debugTemplate = template.Must(template.New("").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("15:04:05.000")
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><title>wc</title>
+<style>
+body{font-family:monospace}
+table{border-collapse:collapse}
+td,th{border:1px solid #ccc;padding:2px 6px;text-align:left;vertical-align:top}
+</style></head><body>
+{{if .Session}}{{with .Session}}
+<p><a href="?">sessions</a></p>
+<h1>{{.SID}}</h1>
+<table>
+<tr><th>back channel</th><td>{{if .BackChannel}}{{.Transport}}
+{{- if .BufferedProxy}} (buffered){{end}}{{else}}closed{{end}}</td></tr>
+<tr><th>back channel bytes</th><td>{{.BackChannelBytes}}</td></tr>
+<tr><th>pending messages</th><td>{{.PendingMessages}}</td></tr>
+<tr><th>back channel AID</th><td>{{.SessionInfo.BackChannelAID}}</td></tr>
+<tr><th>forward channel AID</th><td>{{.SessionInfo.ForwardChannelAID}}</td></tr>
+<tr><th>last forward channel</th><td>{{time .LastForwardChannel}}</td></tr>
+<tr><th>last back channel</th><td>{{time .LastBackChannel}}</td></tr>
+<tr><th>terminating</th><td>{{.Terminating}}</td></tr>
+<tr><th>noop timer</th><td>{{time .NoopAt}}</td></tr>
+<tr><th>back channel close timer</th><td>{{time .BackChannelCloseAt}}</td></tr>
+<tr><th>idle timer</th><td>{{time .IdleTimeoutAt}}</td></tr>
+<tr><th>stop timer</th><td>{{time .StopTimeoutAt}}</td></tr>
+<tr><th>topics</th><td>{{range .Topics}}{{.}} {{end}}</td></tr>
+</table>
+{{end}}
+<h2>Back channel queue</h2>
+<table>
+<tr><th>ID</th><th>body</th></tr>
+{{range .Messages}}<tr><td>{{.ID}}</td><td>{{printf "%s" .Body}}</td></tr>
+{{end}}</table>
+<h2>Debug</h2>
+<table>
+{{range .Session.Debug}}<tr><td>{{time .Time}}</td><td>{{.Message}}</td>
+<td>{{range .Attrs}}{{.}} {{end}}</td></tr>
+{{end}}</table>
+{{else}}
+<h1>Sessions ({{len .Sessions}})</h1>
+<table>
+<tr><th>SID</th><th>back channel</th><th>bytes</th><th>pending</th>
+<th>back AID</th><th>forward AID</th><th>last forward</th><th>last back</th>
+<th>noop</th><th>close</th><th>idle</th></tr>
+{{range .Sessions}}<tr><td><a href="?sid={{.SID}}">{{.SID}}</a></td>
+<td>{{if .BackChannel}}{{.Transport}}{{else}}-{{end}}</td>
+<td>{{.BackChannelBytes}}</td><td>{{.PendingMessages}}</td>
+<td>{{.SessionInfo.BackChannelAID}}</td>
+<td>{{.SessionInfo.ForwardChannelAID}}</td>
+<td>{{time .LastForwardChannel}}</td><td>{{time .LastBackChannel}}</td>
+<td>{{time .NoopAt}}</td><td>{{time .BackChannelCloseAt}}</td>
+<td>{{time .IdleTimeoutAt}}</td></tr>
+{{end}}</table>
+{{end}}
+</body></html>
+`))
+
+type debugData struct {
+	Sessions []*SessionStatus
+	Session  *SessionStatus
+	Messages []*Message
+}
+
+// DebugHandler renders the live state of the Server's sessions as HTML. It is
+// meant to be mounted at a path such as /debug/wc. The sid query parameter
+// selects a single session, showing its back channel queue and its recent
+// debug messages (see Options.DebugHistory).
+//
+// The page includes message bodies, so it should only be reachable by
+// operators.
+func (s *Server) DebugHandler(w http.ResponseWriter, r *http.Request) {
+	data := &debugData{}
+	var err error
+	if sid := r.FormValue("sid"); sid != "" {
+		var serr error
+		err = s.admin(r.Context(), sid, func(sw *sessionWrapper) {
+			data.Session, serr = sessionStatus(sw)
+			if serr == nil {
+				data.Messages, serr = sw.BackChannelPeek()
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+	} else {
+		data.Sessions, err = s.Sessions(r.Context())
+	}
+	switch {
+	case err == ErrUnknownSID:
+		http.Error(w, ErrUnknownSID.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		s.sm.Error(r, err)
+		http.Error(w, "Unable to get session state",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := debugTemplate.Execute(w, data); err != nil {
+		s.sm.Error(r, err)
+	}
+}
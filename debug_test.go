@@ -0,0 +1,77 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugRing(t *testing.T) {
+	const history = 8
+	var d debugRing
+	d.add(slog.NewRecord(time.Now(), slog.LevelDebug, "disabled", 0))
+	if msgs := d.messages(); len(msgs) != 0 {
+		t.Errorf("Found %d messages, want 0", len(msgs))
+	}
+	d.recs = make([]slog.Record, history)
+	for i := 0; i < history+10; i++ {
+		rec := slog.NewRecord(time.Now(), slog.LevelDebug, strconv.Itoa(i), 0)
+		rec.Add("i", i)
+		d.add(rec)
+	}
+	msgs := d.messages()
+	if len(msgs) != history {
+		t.Fatalf("Found %d messages, want %d", len(msgs), history)
+	}
+	for i, msg := range msgs {
+		if want := strconv.Itoa(i + 10); msg.Message != want {
+			t.Errorf("Message %d = %s, want %s", i, msg.Message, want)
+		}
+		want := []slog.Attr{slog.Int("i", i+10)}
+		if !reflect.DeepEqual(msg.Attrs, want) {
+			t.Errorf("Attrs %d = %v, want %v", i, msg.Attrs, want)
+		}
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv := NewServer(&testSessionManager{}, &Options{
+		Logger:       logger,
+		DebugHistory: 1,
+	})
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/bind", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.debug(nil, "wc: first")
+	sw.debug(nil, "wc: second")
+	status, err := srv.SessionStatus(context.Background(), sw.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Debug) != 1 ||
+		status.Debug[0].Message != "wc: second" {
+		t.Errorf("Debug = %v, want the last message", status.Debug)
+	}
+	if err := srv.TerminateSession(context.Background(), sw.SID()); err != nil {
+		t.Fatal(err)
+	}
+	srv.workers.Wait()
+	want := `level=DEBUG msg="wc: admin terminate session" sid=1`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("Found %q, want %q", buf.String(), want)
+	}
+}
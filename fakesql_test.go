@@ -0,0 +1,546 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !sqlite
+
+package wc
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is an in-memory database implementing the subset of SQL used by
+// SQLSessionManager (CREATE TABLE, INSERT, SELECT, UPDATE and DELETE with
+// simple WHERE clauses), so that its tests do not require a database driver.
+// It supports one transaction at a time; use it with SetMaxOpenConns(1).
+//
+// Build with the sqlite tag to run the tests against SQLite instead.
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+	// backup is the state restored by the Rollback of the open transaction.
+	backup map[string]*fakeTable
+}
+
+// openTestDB opens an empty fakeDB.
+func openTestDB(t *testing.T) *sql.DB {
+	db := sql.OpenDB(&fakeDB{})
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+type fakeRow map[string]driver.Value
+
+type fakeTable struct {
+	columns []string
+	key     []string
+	rows    []fakeRow
+}
+
+// clone copies the tables of db.
+func (db *fakeDB) clone() map[string]*fakeTable {
+	tables := make(map[string]*fakeTable)
+	for name, t := range db.tables {
+		c := &fakeTable{columns: t.columns, key: t.key}
+		for _, row := range t.rows {
+			r := make(fakeRow)
+			for k, v := range row {
+				r[k] = v
+			}
+			c.rows = append(c.rows, r)
+		}
+		tables[name] = c
+	}
+	return tables
+}
+
+func (db *fakeDB) table(name string) (*fakeTable, error) {
+	t, ok := db.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+	return t, nil
+}
+
+// Connect implements driver.Connector.
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{db}, nil
+}
+
+// Driver implements driver.Connector.
+func (db *fakeDB) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("fakeDriver: use sql.OpenDB")
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	p := &fakeParser{toks: fakeTokens(query)}
+	exec := p.statement()
+	if p.err == nil && p.pos < len(p.toks) {
+		p.err = fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("fakeDB: %v in %q", p.err, query)
+	}
+	return &fakeStmt{c.db, p.args, exec}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if c.db.backup != nil {
+		return nil, errors.New("fakeDB: transaction already open")
+	}
+	c.db.backup = c.db.clone()
+	return c, nil
+}
+
+func (c fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.backup = nil
+	return nil
+}
+
+func (c fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.tables, c.db.backup = c.db.backup, nil
+	return nil
+}
+
+// fakeExec executes a statement, returning the rows of a SELECT.
+type fakeExec func(db *fakeDB, args []driver.Value) (int64, *fakeRows, error)
+
+type fakeStmt struct {
+	db   *fakeDB
+	args int
+	exec fakeExec
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return s.args
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	n, _, err := s.exec(s.db, args)
+	return driver.RowsAffected(n), err
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	_, rows, err := s.exec(s.db, args)
+	if err == nil && rows == nil {
+		err = errors.New("fakeDB: query returns no rows")
+	}
+	return rows, err
+}
+
+type fakeRows struct {
+	columns []string
+	rows    []fakeRow
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, column := range r.columns {
+		dest[i] = r.rows[0][column]
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeTokens splits query into words and punctuation.
+func fakeTokens(query string) []string {
+	const punct = "(),=+?"
+	toks := []string{}
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.HasPrefix(query[i:], "<="):
+			toks = append(toks, "<=")
+			i += 2
+		case strings.IndexByte(punct, c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		default:
+			j := i
+			for j < len(query) && !strings.ContainsRune(" \t\n<"+punct,
+				rune(query[j])) {
+				j++
+			}
+			toks = append(toks, query[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+// fakeParser parses a statement, recording the first error in err.
+type fakeParser struct {
+	toks []string
+	pos  int
+	args int
+	err  error
+}
+
+func (p *fakeParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *fakeParser) next() string {
+	tok := p.peek()
+	if tok == "" && p.err == nil {
+		p.err = errors.New("unexpected end of statement")
+	}
+	p.pos++
+	return tok
+}
+
+func (p *fakeParser) expect(words ...string) {
+	for _, word := range words {
+		if tok := p.next(); tok != word && p.err == nil {
+			p.err = fmt.Errorf("got %q, want %q", tok, word)
+		}
+	}
+}
+
+// list parses a comma separated list of items enclosed in parentheses.
+func (p *fakeParser) list(item func()) {
+	p.expect("(")
+	for p.err == nil {
+		item()
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	p.expect(")")
+}
+
+// fakeExpr evaluates an expression for a row.
+type fakeExpr func(row fakeRow, args []driver.Value) driver.Value
+
+// expr parses a placeholder, an integer or a column, optionally followed by
+// "+ expr".
+func (p *fakeParser) expr() fakeExpr {
+	var e fakeExpr
+	tok := p.next()
+	switch n, err := strconv.ParseInt(tok, 10, 64); {
+	case tok == "?":
+		i := p.args
+		p.args++
+		e = func(_ fakeRow, args []driver.Value) driver.Value {
+			return args[i]
+		}
+	case err == nil:
+		e = func(fakeRow, []driver.Value) driver.Value { return n }
+	default:
+		e = func(row fakeRow, _ []driver.Value) driver.Value { return row[tok] }
+	}
+	if p.peek() != "+" {
+		return e
+	}
+	p.next()
+	rhs := p.expr()
+	return func(row fakeRow, args []driver.Value) driver.Value {
+		a, _ := e(row, args).(int64)
+		b, _ := rhs(row, args).(int64)
+		return a + b
+	}
+}
+
+// fakeCompare orders two values of the same type.
+func fakeCompare(a, b driver.Value) int {
+	switch a := a.(type) {
+	case int64:
+		b, _ := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// where parses an optional WHERE clause of comparisons joined by AND.
+func (p *fakeParser) where() func(row fakeRow, args []driver.Value) bool {
+	if p.peek() != "WHERE" {
+		return func(fakeRow, []driver.Value) bool { return true }
+	}
+	p.next()
+	var conds []func(row fakeRow, args []driver.Value) bool
+	for p.err == nil {
+		column, op, e := p.next(), p.next(), p.expr()
+		if op != "=" && op != "<=" && p.err == nil {
+			p.err = fmt.Errorf("unsupported operator %q", op)
+		}
+		conds = append(conds, func(row fakeRow, args []driver.Value) bool {
+			c := fakeCompare(row[column], e(row, args))
+			return c == 0 || (op == "<=" && c < 0)
+		})
+		if p.peek() != "AND" {
+			break
+		}
+		p.next()
+	}
+	return func(row fakeRow, args []driver.Value) bool {
+		for _, cond := range conds {
+			if !cond(row, args) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (p *fakeParser) statement() fakeExec {
+	switch p.next() {
+	case "CREATE":
+		return p.create()
+	case "INSERT":
+		return p.insert()
+	case "SELECT":
+		return p.selectRows()
+	case "UPDATE":
+		return p.update()
+	case "DELETE":
+		return p.delete()
+	}
+	p.err = errors.New("unsupported statement")
+	return nil
+}
+
+func (p *fakeParser) create() fakeExec {
+	p.expect("TABLE", "IF", "NOT", "EXISTS")
+	name := p.next()
+	t := &fakeTable{}
+	p.list(func() {
+		if p.peek() == "PRIMARY" {
+			p.expect("PRIMARY", "KEY")
+			p.list(func() { t.key = append(t.key, p.next()) })
+			return
+		}
+		column := p.next()
+		t.columns = append(t.columns, column)
+		// Skip the type and constraints.
+		for depth := 0; p.err == nil; p.next() {
+			switch p.peek() {
+			case "(":
+				depth++
+			case ")":
+				if depth == 0 {
+					return
+				}
+				depth--
+			case ",":
+				if depth == 0 {
+					return
+				}
+			case "PRIMARY":
+				t.key = []string{column}
+			}
+		}
+	})
+	return func(db *fakeDB, _ []driver.Value) (int64, *fakeRows, error) {
+		if db.tables == nil {
+			db.tables = make(map[string]*fakeTable)
+		}
+		if db.tables[name] == nil {
+			db.tables[name] = t
+		}
+		return 0, nil, nil
+	}
+}
+
+func (p *fakeParser) insert() fakeExec {
+	p.expect("INTO")
+	name := p.next()
+	var columns []string
+	var values []fakeExpr
+	p.list(func() { columns = append(columns, p.next()) })
+	p.expect("VALUES")
+	p.list(func() { values = append(values, p.expr()) })
+	if len(columns) != len(values) && p.err == nil {
+		p.err = errors.New("column and value counts differ")
+	}
+	return func(db *fakeDB, args []driver.Value) (int64, *fakeRows, error) {
+		t, err := db.table(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		row := make(fakeRow)
+		for i, column := range columns {
+			v := values[i](nil, args)
+			if b, ok := v.([]byte); ok {
+				v = append([]byte{}, b...)
+			}
+			row[column] = v
+		}
+		for _, column := range t.columns {
+			if row[column] == nil {
+				return 0, nil, fmt.Errorf("NOT NULL constraint failed: %s.%s",
+					name, column)
+			}
+		}
+		for _, r := range t.rows {
+			same := true
+			for _, column := range t.key {
+				same = same && fakeCompare(r[column], row[column]) == 0
+			}
+			if same {
+				return 0, nil, fmt.Errorf("UNIQUE constraint failed: %s", name)
+			}
+		}
+		t.rows = append(t.rows, row)
+		return 1, nil, nil
+	}
+}
+
+func (p *fakeParser) selectRows() fakeExec {
+	var columns []string
+	for p.err == nil {
+		columns = append(columns, p.next())
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	p.expect("FROM")
+	name := p.next()
+	match := p.where()
+	var order string
+	if p.peek() == "ORDER" {
+		p.expect("ORDER", "BY")
+		order = p.next()
+	}
+	return func(db *fakeDB, args []driver.Value) (int64, *fakeRows, error) {
+		t, err := db.table(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		rows := &fakeRows{columns: columns}
+		for _, row := range t.rows {
+			if match(row, args) {
+				rows.rows = append(rows.rows, row)
+			}
+		}
+		if order != "" {
+			sort.SliceStable(rows.rows, func(i, j int) bool {
+				return fakeCompare(rows.rows[i][order], rows.rows[j][order]) < 0
+			})
+		}
+		return int64(len(rows.rows)), rows, nil
+	}
+}
+
+func (p *fakeParser) update() fakeExec {
+	name := p.next()
+	p.expect("SET")
+	var columns []string
+	var values []fakeExpr
+	for p.err == nil {
+		columns = append(columns, p.next())
+		p.expect("=")
+		values = append(values, p.expr())
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	match := p.where()
+	return func(db *fakeDB, args []driver.Value) (int64, *fakeRows, error) {
+		t, err := db.table(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		var n int64
+		for i, row := range t.rows {
+			if !match(row, args) {
+				continue
+			}
+			updated := make(fakeRow)
+			for k, v := range row {
+				updated[k] = v
+			}
+			for j, column := range columns {
+				updated[column] = values[j](row, args)
+			}
+			t.rows[i] = updated
+			n++
+		}
+		return n, nil, nil
+	}
+}
+
+func (p *fakeParser) delete() fakeExec {
+	p.expect("FROM")
+	name := p.next()
+	match := p.where()
+	return func(db *fakeDB, args []driver.Value) (int64, *fakeRows, error) {
+		t, err := db.table(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		kept := []fakeRow{}
+		for _, row := range t.rows {
+			if !match(row, args) {
+				kept = append(kept, row)
+			}
+		}
+		n := int64(len(t.rows) - len(kept))
+		t.rows = kept
+		return n, nil, nil
+	}
+}
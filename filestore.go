@@ -0,0 +1,434 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const defaultCompactRecords = 10000
+
+// Log record operations.
+const (
+	fileOpNew = "new"
+	fileOpAdd = "add"
+	fileOpACK = "ack"
+	fileOpFwd = "fwd"
+	fileOpDel = "del"
+)
+
+// ErrFileStoreClosed is returned when using a FileStore after Close().
+var ErrFileStoreClosed = errors.New("wc: FileStore closed")
+
+// FileForwardChannelFunc processes forward channel messages delivered to a
+// FileSession. See Session.ForwardChannel() for the semantics of the returned
+// error.
+type FileForwardChannelFunc func(s *FileSession, msgs []*Message) error
+
+// fileRecord is a single line of the FileStore log.
+type fileRecord struct {
+	Op   string `json:"op"`
+	SID  string `json:"sid"`
+	ID   int    `json:"id"`
+	Body []byte `json:"body,omitempty"`
+}
+
+// fileSessionState is the persisted state of a single session.
+type fileSessionState struct {
+	queue             messageQueue
+	backChannelAID    int
+	forwardChannelAID int
+}
+
+// FileStore persists the back channel queue and SessionInfo of each session
+// to an append-only log, allowing sessions to be resumed (via LookupSession)
+// after the server restarts. The log is compacted once CompactRecords records
+// have been appended since the previous compaction.
+//
+// Records are written to the operating system as they occur but are not
+// fsynced, so the log survives process restarts but not necessarily
+// operating system crashes.
+//
+// A SessionManager using FileStore typically creates sessions with
+// NewSession(), delegates LookupSession() to the FileStore and calls Remove()
+// from TerminatedSession().
+type FileStore struct {
+	// CompactRecords is the number of appended records which triggers a
+	// compaction of the log. Zero uses the default (10000).
+	CompactRecords int
+
+	mutex    sync.Mutex
+	path     string
+	f        *os.File
+	forward  FileForwardChannelFunc
+	sessions map[string]*fileSessionState
+	records  int
+}
+
+// OpenFileStore opens (or creates) the log at path and restores the sessions
+// it contains. forward is invoked with forward channel messages for every
+// session in the store. A partially written final record (as left by a
+// crash) is discarded, but a corrupt record elsewhere in the log is an error.
+func OpenFileStore(
+	path string,
+	forward FileForwardChannelFunc,
+) (*FileStore, error) {
+	fs := &FileStore{
+		path:     path,
+		forward:  forward,
+		sessions: make(map[string]*fileSessionState),
+	}
+	truncated, err := fs.replay()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs.f = f
+	if truncated {
+		// Rewrite the log so that new records are not appended after the
+		// partial record.
+		if err := fs.compact(); err != nil {
+			if fs.f != nil {
+				fs.f.Close()
+			}
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// replay restores the state recorded in the log. truncated is set when the
+// log ends with a partially written record.
+func (fs *FileStore) replay() (truncated bool, err error) {
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Records are read whole, however large the message body.
+	br := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if len(b) == 0 {
+			return false, nil
+		}
+		var rec fileRecord
+		if jerr := json.Unmarshal(b, &rec); jerr != nil {
+			if _, perr := br.Peek(1); perr == nil {
+				return false, fmt.Errorf("wc: corrupt record on line %d of %s: %v",
+					line, fs.path, jerr)
+			}
+			// A partially written final record is expected after a crash.
+			return true, nil
+		}
+		fs.apply(&rec)
+		fs.records++
+		if err == io.EOF {
+			// The final record lacks its newline, so the log is rewritten
+			// before more records are appended.
+			return true, nil
+		}
+	}
+}
+
+// apply updates the in-memory state for rec. fs.mutex must be held (or fs
+// not yet shared).
+func (fs *FileStore) apply(rec *fileRecord) {
+	if rec.Op == fileOpNew {
+		fs.sessions[rec.SID] = &fileSessionState{
+			backChannelAID:    -1,
+			forwardChannelAID: -1,
+		}
+		return
+	}
+	state, ok := fs.sessions[rec.SID]
+	if !ok {
+		return
+	}
+	switch rec.Op {
+	case fileOpAdd:
+		state.queue.msgs = append(state.queue.msgs, NewMessage(rec.ID, rec.Body))
+		state.queue.nextID = rec.ID + 1
+	case fileOpACK:
+		state.queue.ackThrough(rec.ID)
+		state.backChannelAID = rec.ID
+	case fileOpFwd:
+		state.forwardChannelAID = rec.ID
+	case fileOpDel:
+		delete(fs.sessions, rec.SID)
+	}
+}
+
+// append writes rec to the log and applies it. fs.mutex must be held.
+func (fs *FileStore) append(rec *fileRecord) error {
+	if fs.f == nil {
+		return ErrFileStoreClosed
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	fs.apply(rec)
+	fs.records++
+
+	limit := fs.CompactRecords
+	if limit <= 0 {
+		limit = defaultCompactRecords
+	}
+	if fs.records >= limit {
+		return fs.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the log to contain only the state of live sessions.
+func (fs *FileStore) Compact() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.f == nil {
+		return ErrFileStoreClosed
+	}
+	return fs.compact()
+}
+
+func (fs *FileStore) compact() error {
+	tmpPath := fs.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := 0
+	for sid, state := range fs.sessions {
+		recs := []*fileRecord{&fileRecord{Op: fileOpNew, SID: sid}}
+		for _, msg := range state.queue.msgs {
+			recs = append(recs,
+				&fileRecord{Op: fileOpAdd, SID: sid, ID: msg.ID, Body: msg.Body})
+		}
+		if len(state.queue.msgs) == 0 && state.queue.nextID > 0 {
+			// Preserve the message numbering of an empty queue.
+			recs = append(recs, &fileRecord{Op: fileOpAdd, SID: sid,
+				ID: state.queue.nextID - 1})
+		}
+		if state.backChannelAID >= 0 {
+			recs = append(recs,
+				&fileRecord{Op: fileOpACK, SID: sid, ID: state.backChannelAID})
+		}
+		if state.forwardChannelAID >= 0 {
+			recs = append(recs,
+				&fileRecord{Op: fileOpFwd, SID: sid, ID: state.forwardChannelAID})
+		}
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+		records += len(recs)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return err
+	}
+
+	if fs.f != nil {
+		fs.f.Close()
+	}
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fs.f = nil
+		return err
+	}
+	fs.f = f
+	fs.records = records
+	return nil
+}
+
+// Close compacts and closes the log.
+func (fs *FileStore) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.f == nil {
+		return ErrFileStoreClosed
+	}
+	err := fs.compact()
+	if fs.f != nil {
+		if cerr := fs.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	fs.f = nil
+	return err
+}
+
+// NewSession creates and persists a new session with the specified ID.
+func (fs *FileStore) NewSession(sid string) (*FileSession, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.sessions[sid]; ok {
+		return nil, fmt.Errorf("wc: duplicate SID %s", sid)
+	}
+	if err := fs.append(&fileRecord{Op: fileOpNew, SID: sid}); err != nil {
+		return nil, err
+	}
+	return fs.newFileSession(sid), nil
+}
+
+// LookupSession restores a session persisted in the store. It has the same
+// signature as SessionManager.LookupSession() so a SessionManager may
+// delegate to it directly. ErrUnknownSID is returned for unknown sessions.
+func (fs *FileStore) LookupSession(r *http.Request, sid string) (
+	Session,
+	*SessionInfo,
+	error,
+) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	state, ok := fs.sessions[sid]
+	if !ok {
+		return nil, nil, ErrUnknownSID
+	}
+	s := fs.newFileSession(sid)
+	si := &SessionInfo{
+		// The last ACKed ID; messages after it are retransmitted on the next
+		// back channel.
+		BackChannelAID:    state.backChannelAID,
+		ForwardChannelAID: state.forwardChannelAID,
+	}
+	return s, si, nil
+}
+
+// Remove deletes the session from the store. It is typically called from
+// SessionManager.TerminatedSession().
+func (fs *FileStore) Remove(sid string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.sessions[sid]; !ok {
+		return nil
+	}
+	return fs.append(&fileRecord{Op: fileOpDel, SID: sid})
+}
+
+// FileSession is a Session whose back channel queue and SessionInfo are
+// persisted by a FileStore. Its AuthFunc field, if set, implements
+// Authenticated(); when nil all requests are considered authenticated.
+type FileSession struct {
+	queuedSession
+
+	store *FileStore
+}
+
+func (fs *FileStore) newFileSession(sid string) *FileSession {
+	s := &FileSession{store: fs}
+	s.queuedSession = newQueuedSession(sid, s.BackChannelAdd)
+	return s
+}
+
+// state returns the persisted state of the session. fs.mutex must be held.
+func (s *FileSession) state() (*fileSessionState, error) {
+	state, ok := s.store.sessions[s.SID()]
+	if !ok {
+		return nil, ErrUnknownSID
+	}
+	return state, nil
+}
+
+// BackChannelPeek returns the un-ACKed back channel messages in ID order.
+func (s *FileSession) BackChannelPeek() ([]*Message, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	state, err := s.state()
+	if err != nil {
+		return nil, err
+	}
+	return state.queue.peek(), nil
+}
+
+// BackChannelACKThrough removes all messages up to and including ID from the
+// back channel queue.
+func (s *FileSession) BackChannelACKThrough(ID int) error {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	state, err := s.state()
+	if err != nil {
+		return err
+	}
+	if ID >= state.queue.nextID {
+		return fmt.Errorf("wc: ACK of unsent message %d", ID)
+	}
+	return s.store.append(&fileRecord{Op: fileOpACK, SID: s.SID(), ID: ID})
+}
+
+// BackChannelAdd appends messageBody to the back channel queue using the next
+// message ID. It does not signal DataNotifier(); use Send() from application
+// code.
+func (s *FileSession) BackChannelAdd(messageBody []byte) error {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	state, err := s.state()
+	if err != nil {
+		return err
+	}
+	return s.store.append(&fileRecord{
+		Op:   fileOpAdd,
+		SID:  s.SID(),
+		ID:   state.queue.nextID,
+		Body: messageBody,
+	})
+}
+
+// ForwardChannel passes msgs to the store's FileForwardChannelFunc and then
+// records the largest received ID.
+func (s *FileSession) ForwardChannel(msgs []*Message) error {
+	if s.store.forward != nil {
+		if err := s.store.forward(s, msgs); err != nil {
+			return err
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	if _, err := s.state(); err != nil {
+		return err
+	}
+	return s.store.append(&fileRecord{
+		Op:  fileOpFwd,
+		SID: s.SID(),
+		ID:  msgs[len(msgs)-1].ID,
+	})
+}
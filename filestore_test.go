@@ -0,0 +1,192 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// populateFileStore creates sessions "a" (two un-ACKed messages and a
+// forward channel) and "b" (removed).
+func populateFileStore(t *testing.T, fs *FileStore) {
+	a, err := fs.NewSession("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{`["x"]`, `["y"]`, `["z"]`} {
+		if err := a.BackChannelAdd([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.BackChannelACKThrough(0); err != nil {
+		t.Fatal(err)
+	}
+	fwd := []*Message{NewMessage(4, []byte(`{}`))}
+	if err := a.ForwardChannel(fwd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.NewSession("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFileStore(t *testing.T, fs *FileStore) {
+	s, si, err := fs.LookupSession(nil, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SessionInfo{0, 4}); *si != want {
+		t.Errorf("SessionInfo = %+v, want %+v", *si, want)
+	}
+	msgs, err := s.BackChannelPeek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(msgs), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IDs = %v, want %v", got, want)
+	}
+	if err := s.BackChannelAdd([]byte(`["w"]`)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ = s.BackChannelPeek()
+	got, want := messageIDs(msgs), []int{1, 2, 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IDs after add = %v, want %v", got, want)
+	}
+	if _, _, err := fs.LookupSession(nil, "b"); err != ErrUnknownSID {
+		t.Errorf("removed session lookup error = %v, want ErrUnknownSID", err)
+	}
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+		fs, err := OpenFileStore(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		populateFileStore(t, fs)
+		if compact {
+			if err := fs.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Simulate a crash rather than Close(), which compacts.
+		fs.f.Close()
+
+		fs, err = OpenFileStore(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFileStore(t, fs)
+		if err := fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileStoreTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	fs, err := OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populateFileStore(t, fs)
+	fs.f.Write([]byte(`{"op":"add","sid":"a","id":3,"bo`))
+	fs.f.Close()
+
+	fs, err = OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileStore(t, fs)
+	fs.f.Close()
+
+	// Records appended after recovering from the partial record must survive.
+	fs, err = OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := fs.LookupSession(nil, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := s.BackChannelPeek()
+	got, want := messageIDs(msgs), []int{1, 2, 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IDs = %v, want %v", got, want)
+	}
+	fs.Close()
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary compaction file remains: %v", err)
+	}
+}
+
+func TestFileStoreLargeRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	fs, err := OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := fs.NewSession("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Over 8 MiB once base64 and JSON encoded.
+	body := []byte(`"` + strings.Repeat("x", 6<<20) + `"`)
+	if err := s.BackChannelAdd(body); err != nil {
+		t.Fatal(err)
+	}
+	fs.f.Close()
+
+	fs, err = OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	session, _, err := fs.LookupSession(nil, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := session.BackChannelPeek()
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Body, body) {
+		t.Errorf("found %d messages, want the large message", len(msgs))
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	fs, err := OpenFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populateFileStore(t, fs)
+	fs.Close()
+
+	// Only the final record may be partial; a corrupt record followed by
+	// others fails rather than discarding the rest of the log.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte("{\"op\":\n"), b...)
+	if err := os.WriteFile(path, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileStore(path, nil); err == nil {
+		t.Error("OpenFileStore succeeded with a corrupt record")
+	}
+	if b, err := os.ReadFile(path); err != nil || !bytes.Equal(b, corrupt) {
+		t.Errorf("corrupt log was rewritten: %v", err)
+	}
+}
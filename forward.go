@@ -6,29 +6,37 @@ package wc
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
 func newSessionHandler(sw *sessionWrapper, reqRequest *reqRegister) {
-	debug("wc: %s forward channel (new session)", sw.SID())
+	sw.debug(reqRequest.r, "wc: forward channel (new session)")
 	defer func() {
 		reqRequest.done <- struct{}{}
 	}()
 
 	createMsg := []byte(jsonArray(
-		[]interface{}{"c", sw.SID(), sm.HostPrefix(), 8},
+		[]interface{}{"c", sw.SID(), sw.srv.sm.HostPrefix(), 8},
 	))
-	if err := sw.BackChannelAdd(createMsg); err != nil {
-		sm.Error(reqRequest.r, err)
+	if _, err := sw.addInternal(createMsg); err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
 		http.Error(reqRequest.w, "Unable to add create message to back channel",
 			http.StatusInternalServerError)
 		return
 	}
 
+	if err := carryOverMessages(sw, reqRequest.r); err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
+		writeRestartError(reqRequest.w, err)
+		return
+	}
+
 	if err := sw.BackChannelNewSessionMessages(); err != nil {
-		sm.Error(reqRequest.r, err)
+		sw.srv.sm.Error(reqRequest.r, err)
 		http.Error(reqRequest.w, "Unable to add messages for new session",
 			http.StatusInternalServerError)
 		return
@@ -36,18 +44,31 @@ func newSessionHandler(sw *sessionWrapper, reqRequest *reqRegister) {
 
 	msgs, err := sw.BackChannelPeek()
 	if err != nil {
-		sm.Error(reqRequest.r, err)
+		sw.srv.sm.Error(reqRequest.r, err)
 		http.Error(reqRequest.w, "Unable to get messages",
 			http.StatusInternalServerError)
 		return
 	}
+	// The messages remain un-ACKed until the next request from the client.
+	sw.backChannelBytes = messageBytes(msgs)
 
 	p := newPadder(reqRequest.w, reqRequest.r)
 	p.writeMessages(msgs)
+	sw.srv.metric(MetricBackChannelMessages, int64(len(msgs)))
+	sw.srv.metric(MetricBackChannelBytes, int64(sw.backChannelBytes))
+}
+
+// messageBytes returns the total body size of msgs.
+func messageBytes(msgs []*Message) int {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg.Body)
+	}
+	return n
 }
 
 func fcHandler(sw *sessionWrapper, reqRequest *reqRegister) {
-	debug("wc: %s forward channel", sw.SID())
+	sw.debug(reqRequest.r, "wc: forward channel")
 	defer func() {
 		reqRequest.done <- struct{}{}
 	}()
@@ -57,52 +78,23 @@ func fcHandler(sw *sessionWrapper, reqRequest *reqRegister) {
 		return
 	}
 
-	count, err := strconv.Atoi(reqRequest.r.PostFormValue("count"))
-	if err != nil {
-		sm.Error(reqRequest.r, err)
-		http.Error(reqRequest.w, "Unable to parse count", 400)
+	if err := reqRequest.r.ParseForm(); err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
+		http.Error(reqRequest.w, "Unable to parse form", 400)
 		return
 	}
-
-	msgs := []*Message{}
-	if count > 0 {
-		offset, err := strconv.Atoi(reqRequest.r.PostFormValue("ofs"))
-		if err != nil {
-			sm.Error(reqRequest.r, err)
-			http.Error(reqRequest.w, "Unable to parse ofs", 400)
-			return
-		}
-
-		for i := 0; i < count; i++ {
-			req := fmt.Sprintf("req%d", i)
-			jsonMap := make(map[string]interface{})
-			for key, value := range reqRequest.r.PostForm {
-				keyParts := strings.SplitN(key, "_", 2)
-				if len(keyParts) < 2 || keyParts[0] != req {
-					continue
-				}
-				jsonMap[keyParts[1]] = value[0]
-			}
-			effectiveID := offset + i
-			if effectiveID <= sw.si.ForwardChannelAID {
-				// skip incoming messages which have already been received
-				continue
-			}
-			msg := &Message{ID: offset + i, Body: []byte(jsonObject(jsonMap))}
-			msgs = append(msgs, msg)
-			debug("wc: %s new forward channel message %d %s", sw.Session.SID(),
-				msg.ID, msg.Body)
-		}
+	msgs, err := forwardMessages(sw, reqRequest.r.PostForm)
+	if err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
+		http.Error(reqRequest.w, "Unable to parse forward channel messages", 400)
+		return
 	}
 
-	if len(msgs) > 0 {
-		err = sw.ForwardChannel(msgs)
-		if err != nil {
-			sm.Error(reqRequest.r, err)
-			http.Error(reqRequest.w, "Incoming message error",
-				http.StatusInternalServerError)
-			return
-		}
+	if err := deliverForward(sw, msgs); err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
+		http.Error(reqRequest.w, "Incoming message error",
+			http.StatusInternalServerError)
+		return
 	}
 
 	reply := []interface{}{
@@ -113,3 +105,95 @@ func fcHandler(sw *sessionWrapper, reqRequest *reqRegister) {
 	p := newPadder(reqRequest.w, reqRequest.r)
 	p.write(jsonArray(reply))
 }
+
+// deliverForward passes msgs to the Session and records the ID of the last
+// as the forward channel AID, so that messages retransmitted by the client
+// are skipped by forwardMessages.
+func deliverForward(sw *sessionWrapper, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := sw.ForwardChannel(msgs); err != nil {
+		return err
+	}
+	sw.si.ForwardChannelAID = msgs[len(msgs)-1].ID
+	sw.srv.metric(MetricForwardMessages, int64(len(msgs)))
+	return nil
+}
+
+// maxForwardMessages is the largest count accepted in a forward channel
+// request. The closure client sends at most 1000 maps per request
+// (goog.net.BrowserChannel.MAX_MAPS_PER_REQUEST_).
+const maxForwardMessages = 1000
+
+// forwardMessages decodes the count, ofs and reqN_key fields of a forward
+// channel request into Messages. Messages which have already been received
+// are skipped.
+func forwardMessages(sw *sessionWrapper, form url.Values) ([]*Message, error) {
+	msgs, err := parseForwardMessages(form, sw.si.ForwardChannelAID)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		sw.debug(nil, "wc: new forward channel message", "id", msg.ID,
+			bodyAttr(msg.Body))
+	}
+	return msgs, nil
+}
+
+// parseForwardMessages decodes the messages of form with IDs greater than
+// lastID. Each reqN_key field is the key of message ofs+N, for N in
+// [0, count).
+func parseForwardMessages(form url.Values, lastID int) ([]*Message, error) {
+	count, err := strconv.Atoi(form.Get("count"))
+	if err != nil {
+		return nil, fmt.Errorf("wc: unable to parse count: %v", err)
+	}
+
+	msgs := []*Message{}
+	if count <= 0 {
+		return msgs, nil
+	}
+	if count > maxForwardMessages {
+		return nil, fmt.Errorf("wc: count %d exceeds %d", count,
+			maxForwardMessages)
+	}
+	offset, err := strconv.Atoi(form.Get("ofs"))
+	if err != nil {
+		return nil, fmt.Errorf("wc: unable to parse ofs: %v", err)
+	}
+	if offset < 0 || offset > math.MaxInt32-count {
+		return nil, fmt.Errorf("wc: ofs %d out of range", offset)
+	}
+
+	jsonMaps := make([]map[string]interface{}, count)
+	for key, value := range form {
+		req, name, ok := strings.Cut(key, "_")
+		if !ok || !strings.HasPrefix(req, "req") {
+			continue
+		}
+		// Only the canonical form of N (no sign or leading zeros) is
+		// accepted, so that each field belongs to exactly one message.
+		i, err := strconv.Atoi(req[len("req"):])
+		if err != nil || i < 0 || i >= count || req != "req"+strconv.Itoa(i) {
+			continue
+		}
+		if jsonMaps[i] == nil {
+			jsonMaps[i] = make(map[string]interface{})
+		}
+		jsonMaps[i][name] = value[0]
+	}
+
+	for i, jsonMap := range jsonMaps {
+		if offset+i <= lastID {
+			// skip incoming messages which have already been received
+			continue
+		}
+		if jsonMap == nil {
+			jsonMap = make(map[string]interface{})
+		}
+		msg := &Message{ID: offset + i, Body: []byte(jsonObject(jsonMap))}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardMessages(t *testing.T) {
+	tests := []struct {
+		body   string
+		lastID int
+		want   []string
+		err    bool
+	}{
+		{"count=0", -1, []string{}, false},
+		{"count=2&ofs=5&req0_a=1&req1_b=2&req1_c=3", -1,
+			[]string{`5 {"a":"1"}`, `6 {"b":"2","c":"3"}`}, false},
+		// Already received messages are skipped.
+		{"count=2&ofs=5&req0_a=1&req1_b=2", 5, []string{`6 {"b":"2"}`}, false},
+		// Fields outside [0, count) or not in canonical form are ignored.
+		{"count=1&ofs=0&req0_a=1&req1_b=2&req00_c=3&req+0_d=4&req-1_e=5&" +
+			"reqx_f=6&req0=7", -1, []string{`0 {"a":"1"}`}, false},
+		{"count=1&ofs=0&req0_=1&req0_a_b=2", -1,
+			[]string{`0 {"":"1","a_b":"2"}`}, false},
+		{"count=1&ofs=0", -1, []string{`0 {}`}, false},
+		{"", -1, nil, true},
+		{"count=x", -1, nil, true},
+		{"count=1", -1, nil, true},
+		{"count=1&ofs=-1", -1, nil, true},
+		{"count=2&ofs=2147483646", -1, nil, true},
+		{"count=1001&ofs=0", -1, nil, true},
+	}
+	for _, test := range tests {
+		form, err := url.ParseQuery(test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := parseForwardMessages(form, test.lastID)
+		if (err != nil) != test.err {
+			t.Errorf("%s: err = %v, want error %v", test.body, err, test.err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		got := []string{}
+		for _, msg := range msgs {
+			got = append(got, strconv.Itoa(msg.ID)+" "+string(msg.Body))
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func FuzzParseForwardMessages(f *testing.F) {
+	f.Add("count=2&ofs=5&req0_a=1&req1_b=2", -1)
+	f.Add("count=1&ofs=0&req0_a=1&req00_b=2&req+0_c=3", 3)
+	f.Add("count=1000&ofs=2147482647&req999_a=%FF", 0)
+	f.Add("count=3&ofs=9223372036854775807&req2_=", -1)
+	f.Fuzz(func(t *testing.T, body string, lastID int) {
+		form, err := url.ParseQuery(body)
+		if err != nil {
+			return
+		}
+		msgs, err := parseForwardMessages(form, lastID)
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(form.Get("count"))
+		ofs, _ := strconv.Atoi(form.Get("ofs"))
+		if len(msgs) > count {
+			t.Fatalf("%d messages for count %d", len(msgs), count)
+		}
+		next := ofs
+		if lastID >= next {
+			next = lastID + 1
+		}
+		for _, msg := range msgs {
+			// IDs are consecutive, start after lastID and lie within
+			// [ofs, ofs+count).
+			if msg.ID != next || msg.ID < ofs || msg.ID >= ofs+count {
+				t.Fatalf("message ID %d, want %d (ofs %d count %d)", msg.ID,
+					next, ofs, count)
+			}
+			next++
+
+			var fields map[string]string
+			if err := json.Unmarshal(msg.Body, &fields); err != nil {
+				t.Fatalf("invalid body %s: %v", msg.Body, err)
+			}
+			// The body holds exactly the reqN_ fields of the message (with
+			// invalid UTF-8 replaced as by encoding/json).
+			prefix := "req" + strconv.Itoa(msg.ID-ofs) + "_"
+			names := map[string]bool{}
+			for key, values := range form {
+				name, ok := strings.CutPrefix(key, prefix)
+				if !ok {
+					continue
+				}
+				names[jsonString(name)] = true
+				if jsonString(name) != name {
+					// Names with invalid UTF-8 may collide once replaced.
+					continue
+				}
+				if got, want := fields[name], jsonString(values[0]); got != want {
+					t.Fatalf("field %s = %q, want %q", key, got, want)
+				}
+			}
+			if len(fields) != len(names) {
+				t.Fatalf("body %s has %d fields, want %d", msg.Body,
+					len(fields), len(names))
+			}
+		}
+	})
+}
+
+// jsonString returns s as encoded and decoded by encoding/json.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	json.Unmarshal(b, &s)
+	return s
+}
+
+func TestForwardChannelRetransmit(t *testing.T) {
+	sm := &testSessionManager{forward: echo}
+	srv, url := newTestServer(t, sm, nil)
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+
+	// A client which does not see the reply to a forward channel request
+	// sends its messages again, along with any new ones.
+	forward(t, url, "1", "count=1&ofs=0&req0_a=1")
+	forward(t, url, "1", "count=1&ofs=0&req0_a=1")
+	forward(t, url, "1", "count=2&ofs=0&req0_a=1&req1_b=2")
+	msgs, err := sm.session("1").BackChannelPeek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The forward channel requests ACKed the create message.
+	got := bodies(msgs)
+	if want := []string{`{"a":"1"}`, `{"b":"2"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarded %v, want %v", got, want)
+	}
+	status, err := srv.SessionStatus(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SessionInfo.ForwardChannelAID != 1 {
+		t.Errorf("ForwardChannelAID = %d, want 1",
+			status.SessionInfo.ForwardChannelAID)
+	}
+}
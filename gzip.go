@@ -18,8 +18,8 @@ const (
 
 // GZIPResponseWriter wraps a http.ResponseWriter and provides optional
 // gzip compression. Streaming HTTP chunks is supported using the
-// http.Flusher interface. Close notification is supported via the
-// http.CloseNotifier interface.
+// http.Flusher interface. The underlying http.ResponseWriter is available via
+// Unwrap() for use with http.ResponseController.
 type GZIPResponseWriter struct {
 	*gzip.Writer
 	http.ResponseWriter
@@ -113,7 +113,7 @@ func (w *GZIPResponseWriter) Flush() {
 	if w.Writer != nil {
 		w.Writer.Flush()
 	}
-	w.ResponseWriter.(http.Flusher).Flush()
+	newFlusher(w.ResponseWriter).Flush()
 }
 
 // Close cleans up the underlying gzip.Writer (if necessary).
@@ -126,10 +126,18 @@ func (w *GZIPResponseWriter) Close() {
 }
 
 // CloseNotify return the underlying CloseNotify() channel.
+//
+// Deprecated: wc detects closed back channels via the request context and
+// never calls CloseNotify. Use Request.Context() instead.
 func (w *GZIPResponseWriter) CloseNotify() <-chan bool {
 	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
 }
 
+// Unwrap returns the underlying http.ResponseWriter.
+func (w *GZIPResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // NewGZIPResponseWriter creates a new GZIPResponseWriter. The http.Request is
 // necessary to check if the browser supports GZIP compression and will not be
 // used after the call to NewGZIPResponseWriter returns.
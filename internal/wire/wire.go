@@ -0,0 +1,82 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wire parses the XMLHTTP responses of the WebChannel protocol, for
+// the Go client of package wc and the test browser of package wctest.
+package wire
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message is a back channel message.
+type Message struct {
+	ID   int
+	Body []byte
+}
+
+// ReadChunk reads a single length prefixed chunk of a back channel or
+// forward channel response, as read by the JavaScript client (the length is
+// in UTF-16 code units). io.EOF is returned at the end of the response.
+func ReadChunk(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("wc: invalid chunk length %q", line)
+	}
+	chunk := []byte{}
+	for units := 0; units < length; {
+		r, size, err := br.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if r == utf8.RuneError && size == 1 {
+			return nil, errors.New("wc: invalid UTF-8 in chunk")
+		}
+		chunk = utf8.AppendRune(chunk, r)
+		units++
+		if r >= 0x10000 {
+			// Encoded as a surrogate pair in UTF-16.
+			units++
+		}
+	}
+	return chunk, nil
+}
+
+// DecodeMessages parses a back channel chunk, a JSON array of [ID, body]
+// pairs.
+func DecodeMessages(chunk []byte) ([]Message, error) {
+	var pairs [][]json.RawMessage
+	if err := json.Unmarshal(chunk, &pairs); err != nil {
+		return nil, fmt.Errorf("wc: unable to parse messages: %v", err)
+	}
+	msgs := make([]Message, 0, len(pairs))
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("wc: invalid message %s", chunk)
+		}
+		msg := Message{Body: []byte(pair[1])}
+		if err := json.Unmarshal(pair[0], &msg.ID); err != nil {
+			return nil, fmt.Errorf("wc: invalid message ID %s", pair[0])
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
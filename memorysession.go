@@ -0,0 +1,149 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ForwardChannelFunc processes forward channel messages delivered to a
+// MemorySession. See Session.ForwardChannel() for the semantics of the
+// returned error.
+type ForwardChannelFunc func(s *MemorySession, msgs []*Message) error
+
+// MemorySession is a complete Session implementation which keeps the back
+// channel queue in memory. It is suitable for applications which do not need
+// sessions to survive server restarts.
+//
+// Application code sends back channel messages with Send(), which may be
+// called from any goroutine (including from within the ForwardChannelFunc).
+// Its AuthFunc field, if set, implements Authenticated(); when nil all
+// requests are considered authenticated.
+type MemorySession struct {
+	queuedSession
+
+	forward ForwardChannelFunc
+	mutex   sync.Mutex
+	queue   messageQueue
+}
+
+// NewMemorySession creates a MemorySession with the specified ID. forward is
+// invoked with each batch of forward channel messages.
+func NewMemorySession(sid string, forward ForwardChannelFunc) *MemorySession {
+	s := &MemorySession{forward: forward}
+	s.queuedSession = newQueuedSession(sid, s.BackChannelAdd)
+	return s
+}
+
+// queuedSession implements Authenticated() and Send() for the Session types
+// which queue back channel messages with BackChannelAdd() (MemorySession,
+// FileSession and SQLSession).
+type queuedSession struct {
+	*DefaultSession
+
+	// AuthFunc, if set, implements Authenticated(). When nil all requests are
+	// considered authenticated.
+	AuthFunc func(r *http.Request) bool
+
+	// add is the BackChannelAdd() method of the session.
+	add func(messageBody []byte) error
+}
+
+func newQueuedSession(
+	sid string,
+	add func(messageBody []byte) error,
+) queuedSession {
+	return queuedSession{DefaultSession: NewDefaultSession(sid), add: add}
+}
+
+// Authenticated invokes AuthFunc (if set).
+func (s *queuedSession) Authenticated(r *http.Request) bool {
+	if s.AuthFunc == nil {
+		return true
+	}
+	return s.AuthFunc(r)
+}
+
+// Send queues messageBody on the back channel and notifies wc of the new
+// data. ErrSessionTerminated is returned once the session has been
+// terminated.
+func (s *queuedSession) Send(messageBody []byte) error {
+	select {
+	case <-s.Done():
+		return ErrSessionTerminated
+	default:
+	}
+	if err := s.add(messageBody); err != nil {
+		return err
+	}
+	return s.NotifyData(len(messageBody))
+}
+
+// BackChannelPeek returns the un-ACKed back channel messages in ID order.
+func (s *MemorySession) BackChannelPeek() ([]*Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queue.peek(), nil
+}
+
+// BackChannelACKThrough removes all messages up to and including ID from the
+// back channel queue.
+func (s *MemorySession) BackChannelACKThrough(ID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queue.ackThrough(ID)
+}
+
+// BackChannelAdd appends messageBody to the back channel queue using the next
+// message ID. It does not signal DataNotifier(); use Send() from application
+// code.
+func (s *MemorySession) BackChannelAdd(messageBody []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queue.add(messageBody)
+	return nil
+}
+
+// ForwardChannel passes msgs to the ForwardChannelFunc.
+func (s *MemorySession) ForwardChannel(msgs []*Message) error {
+	if s.forward == nil {
+		return nil
+	}
+	return s.forward(s, msgs)
+}
+
+// messageQueue is an ID sequenced back channel queue. Callers provide
+// synchronization.
+type messageQueue struct {
+	msgs   []*Message
+	nextID int
+}
+
+func (q *messageQueue) add(body []byte) *Message {
+	msg := NewMessage(q.nextID, body)
+	q.msgs = append(q.msgs, msg)
+	q.nextID++
+	return msg
+}
+
+func (q *messageQueue) peek() []*Message {
+	msgs := make([]*Message, len(q.msgs))
+	copy(msgs, q.msgs)
+	return msgs
+}
+
+func (q *messageQueue) ackThrough(ID int) error {
+	if ID >= q.nextID {
+		return fmt.Errorf("wc: ACK of unsent message %d", ID)
+	}
+	i := 0
+	for i < len(q.msgs) && q.msgs[i].ID <= ID {
+		i++
+	}
+	q.msgs = q.msgs[i:]
+	return nil
+}
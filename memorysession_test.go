@@ -0,0 +1,79 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func messageIDs(msgs []*Message) []int {
+	ids := []int{}
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestMemorySessionQueue(t *testing.T) {
+	s := NewMemorySession("sid", nil)
+	for _, body := range []string{`["c"]`, `["a"]`, `["b"]`} {
+		if err := s.BackChannelAdd([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		ack  int
+		want []int
+		err  bool
+	}{
+		{-1, []int{0, 1, 2}, false},
+		{0, []int{1, 2}, false},
+		{0, []int{1, 2}, false},
+		{2, []int{}, false},
+		{3, []int{}, true},
+	}
+	for _, test := range tests {
+		err := s.BackChannelACKThrough(test.ack)
+		if (err != nil) != test.err {
+			t.Errorf("ACK %d: found error %v, want error %t", test.ack, err,
+				test.err)
+		}
+		msgs, _ := s.BackChannelPeek()
+		if got := messageIDs(msgs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ACK %d: found %v, want %v", test.ack, got, test.want)
+		}
+	}
+}
+
+func TestMemorySessionSend(t *testing.T) {
+	s := NewMemorySession("sid", nil)
+	notified := make(chan int, 1)
+	go func() {
+		notified <- <-s.DataNotifier()
+	}()
+	if err := s.Send([]byte(`["hello"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-notified; n != 9 {
+		t.Errorf("Found %d bytes notified, want 9", n)
+	}
+	s.Close()
+	if err := s.Send([]byte(`["late"]`)); err != ErrSessionTerminated {
+		t.Errorf("Found %v, want %v", err, ErrSessionTerminated)
+	}
+}
+
+func TestMemorySessionForwardChannel(t *testing.T) {
+	var got []*Message
+	s := NewMemorySession("sid", func(s *MemorySession, msgs []*Message) error {
+		got = append(got, msgs...)
+		return nil
+	})
+	s.ForwardChannel([]*Message{NewMessage(4, []byte(`{"a":"b"}`))})
+	if len(got) != 1 || got[0].ID != 4 {
+		t.Errorf("Found %v, want message 4", messageIDs(got))
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Metric names passed to Metrics.Add(). Gauges are adjusted up and down by
+// delta; all other metrics are counters.
+const (
+	// MetricSessions is a gauge of the active sessions.
+	MetricSessions = "sessions"
+	// MetricBackChannels is a gauge of the open back channels.
+	MetricBackChannels = "back_channels"
+	// MetricForwardMessages counts forward channel messages received.
+	MetricForwardMessages = "forward_messages"
+	// MetricBackChannelMessages and MetricBackChannelBytes count the back
+	// channel messages (and their body bytes) written to clients.
+	MetricBackChannelMessages = "back_channel_messages"
+	MetricBackChannelBytes    = "back_channel_bytes"
+	// MetricNoops counts noop messages sent.
+	MetricNoops = "noops"
+	// MetricBufferedProxyCloses counts buffered-proxy (CI=1) back channels
+	// closed to deliver messages.
+	MetricBufferedProxyCloses = "buffered_proxy_closes"
+	// MetricClientTerminations and MetricServerTerminations count sessions
+	// terminated with ClientTerminateRequest and ServerTerminateRequest.
+	MetricClientTerminations = "client_terminations"
+	MetricServerTerminations = "server_terminations"
+	// MetricUnknownSID counts 'Unknown SID' responses.
+	MetricUnknownSID = "unknown_sid"
+)
+
+// Metrics receives the counters and gauges of a Server (see Options.Metrics)
+// and may be implemented to adapt them to a metrics collector. Add is called
+// concurrently from many goroutines and must not block.
+type Metrics interface {
+	// Add adds delta to the named metric.
+	Add(name string, delta int64)
+}
+
+// ExpvarMetrics publishes metrics with expvar, as an expvar.Map of the
+// metric names.
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics creates an ExpvarMetrics published under name. As with
+// expvar.Publish(), it panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{expvar.NewMap(name)}
+}
+
+// Add adds delta to the named metric.
+func (m *ExpvarMetrics) Add(name string, delta int64) {
+	m.m.Add(name, delta)
+}
+
+var (
+	defaultMetricsOnce sync.Once
+	defaultMetrics     Metrics
+)
+
+// expvarMetrics returns the ExpvarMetrics shared by Servers without
+// Options.Metrics, which is published as "wc".
+func expvarMetrics() Metrics {
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics = NewExpvarMetrics("wc")
+	})
+	return defaultMetrics
+}
+
+// metric adds delta to the named metric of the Server.
+func (s *Server) metric(name string, delta int64) {
+	s.options.Metrics.Add(name, delta)
+}
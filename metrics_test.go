@@ -0,0 +1,49 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type testMetrics struct {
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+func (m *testMetrics) Add(name string, delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[name] += delta
+}
+
+func TestMetrics(t *testing.T) {
+	m := &testMetrics{values: make(map[string]int64)}
+	srv := NewServer(&testSessionManager{}, &Options{Metrics: m})
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/bind", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.TerminateSession(context.Background(), sw.SID()); err != nil {
+		t.Fatal(err)
+	}
+	srv.BindHandler(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/bind?SID=unknown&AID=0&TYPE=xmlhttp", nil))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	want := map[string]int64{
+		MetricSessions:           0,
+		MetricServerTerminations: 1,
+		MetricUnknownSID:         1,
+	}
+	if !reflect.DeepEqual(m.values, want) {
+		t.Errorf("Found %v, want %v", m.values, want)
+	}
+}
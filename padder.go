@@ -9,9 +9,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
-	"unicode/utf16"
-	"unicode/utf8"
+	"strconv"
+	"strings"
 )
 
 type paddingType int
@@ -20,6 +21,7 @@ const (
 	none paddingType = iota
 	length
 	script
+	eventStream
 )
 
 var (
@@ -36,12 +38,22 @@ var (
 		"<script>try{parent.d()}catch(e){}</script>"))
 )
 
+// eventStreamNewlines normalizes the line endings of text/event-stream data
+// to LF.
+var eventStreamNewlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
 type padder struct {
 	w      http.ResponseWriter
 	f      http.Flusher
 	t      paddingType
 	setup  bool
 	domain string
+	// eventID is the id field of the next text/event-stream event.
+	eventID string
+	// buffered responses (CI=1) are written in full by end() with a
+	// Content-Length rather than flushed chunk by chunk.
+	buffered bool
+	buf      bytes.Buffer
 }
 
 type startData struct {
@@ -69,19 +81,50 @@ func jsonObject(vals map[string]interface{}) string {
 }
 
 func guessType(r *http.Request) paddingType {
-	if r.FormValue("TYPE") == "html" {
+	switch r.FormValue("TYPE") {
+	case "html":
 		return script
+	case "eventsource":
+		return eventStream
 	}
 	return length
 }
 
+// responseControllerFlusher flushes ResponseWriters which do not implement
+// http.Flusher directly (such as those wrapped by middleware which provide an
+// Unwrap method). When the ResponseWriter cannot be flushed at all, chunks are
+// delivered once the response completes.
+type responseControllerFlusher struct {
+	rc *http.ResponseController
+}
+
+func (f responseControllerFlusher) Flush() {
+	f.rc.Flush()
+}
+
+func newFlusher(w http.ResponseWriter) http.Flusher {
+	if f, ok := w.(http.Flusher); ok {
+		return f
+	}
+	return responseControllerFlusher{http.NewResponseController(w)}
+}
+
 func newPadder(w http.ResponseWriter, r *http.Request) *padder {
-	f, ok := w.(http.Flusher)
-	if !ok {
-		panic("webserver doesn't support flushing")
+	return &padder{
+		w:        w,
+		f:        newFlusher(w),
+		t:        guessType(r),
+		domain:   r.FormValue("DOMAIN"),
+		buffered: r.FormValue("CI") == "1",
+	}
+}
+
+// out returns the writer for response data.
+func (p *padder) out() io.Writer {
+	if p.buffered {
+		return &p.buf
 	}
-	t := guessType(r)
-	return &padder{w, f, t, false, r.FormValue("DOMAIN")}
+	return p.w
 }
 
 func (p *padder) start() error {
@@ -97,9 +140,11 @@ func (p *padder) start() error {
 	case script:
 		header.Set("Content-Type", "text/html; charset=utf-8")
 		d := startData{p.domain}
-		if err := scriptStart.Execute(p.w, d); err != nil {
+		if err := scriptStart.Execute(p.out(), d); err != nil {
 			return err
 		}
+	case eventStream:
+		header.Set("Content-Type", "text/event-stream; charset=utf-8")
 	default:
 		header.Set("Content-Type", "text/plain; charset=utf-8")
 	}
@@ -120,6 +165,10 @@ func (p *padder) prepMessages(msgs []*Message) string {
 }
 
 func (p *padder) chunkMessages(msgs []*Message) error {
+	if p.t == eventStream && len(msgs) > 0 {
+		// EventSource sends the last id back as Last-Event-ID on reconnect.
+		p.eventID = strconv.Itoa(msgs[len(msgs)-1].ID)
+	}
 	return p.chunk(p.prepMessages(msgs))
 }
 
@@ -131,7 +180,9 @@ func (p *padder) chunk(b string) error {
 	if err := p.writeInternal(b); err != nil {
 		return err
 	}
-	p.f.Flush()
+	if !p.buffered {
+		p.f.Flush()
+	}
 	return nil
 }
 
@@ -151,30 +202,50 @@ func (p *padder) writeInternal(b string) error {
 			return err
 		}
 	}
+	// Browsers replace invalid UTF-8 when decoding, but not necessarily with
+	// the same number of replacement characters as Go. Replace it here so
+	// that lengths and escaping are computed on the string the client
+	// decodes.
+	b = strings.ToValidUTF8(b, "\uFFFD")
 	switch p.t {
 	case script:
 		d := messageData{b}
-		if err := scriptMessage.Execute(p.w, d); err != nil {
+		if err := scriptMessage.Execute(p.out(), d); err != nil {
 			return err
 		}
 	case length:
-		runeCount := utf8.RuneCountInString(b)
-		jsLength := runeCount
-		for _, r := range []rune(b) {
-			// Internally js uses utf-16 for strings (after parsing them out of a
-			// utf-8 context). In utf-16, non-bmp characters (code points >= U+10000)
-			// are represented as surrogate pairs (length 2, not 1). Double count
-			// code points represented as surrogate pairs in JS
-			// http://mathiasbynens.be/notes/javascript-encoding
-			if r1, r2 := utf16.EncodeRune(r); r1 != '\uFFFD' && r2 != '\uFFFD' {
+		// Internally js uses utf-16 for strings (after parsing them out of a
+		// utf-8 context). In utf-16, non-bmp characters (code points >= U+10000)
+		// are represented as surrogate pairs (length 2, not 1).
+		// http://mathiasbynens.be/notes/javascript-encoding
+		jsLength := 0
+		for _, r := range b {
+			if r >= 0x10000 {
+				jsLength += 2
+			} else {
 				jsLength++
 			}
 		}
-		if _, err := fmt.Fprintf(p.w, "%d\n%s", jsLength, b); err != nil {
+		if _, err := fmt.Fprintf(p.out(), "%d\n%s", jsLength, b); err != nil {
+			return err
+		}
+	case eventStream:
+		buf := new(bytes.Buffer)
+		if p.eventID != "" {
+			fmt.Fprintf(buf, "id: %s\n", p.eventID)
+			p.eventID = ""
+		}
+		// A CR, LF or CRLF ends an event stream line, so each becomes a
+		// separate data line (which the client joins with LF).
+		for _, line := range strings.Split(eventStreamNewlines.Replace(b), "\n") {
+			fmt.Fprintf(buf, "data: %s\n", line)
+		}
+		buf.Write([]byte("\n"))
+		if _, err := p.out().Write(buf.Bytes()); err != nil {
 			return err
 		}
 	default:
-		if _, err := p.w.Write([]byte(b)); err != nil {
+		if _, err := p.out().Write([]byte(b)); err != nil {
 			return err
 		}
 	}
@@ -189,9 +260,19 @@ func (p *padder) end() error {
 	}
 	if p.t == script {
 		d := struct{}{}
-		if err := scriptEnd.Execute(p.w, d); err != nil {
+		if err := scriptEnd.Execute(p.out(), d); err != nil {
+			return err
+		}
+		if !p.buffered {
+			p.f.Flush()
+		}
+	}
+	if p.buffered {
+		p.w.Header().Set("Content-Length", strconv.Itoa(p.buf.Len()))
+		if _, err := p.w.Write(p.buf.Bytes()); err != nil {
 			return err
 		}
+		p.buf.Reset()
 		p.f.Flush()
 	}
 	return nil
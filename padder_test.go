@@ -8,7 +8,15 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 const (
@@ -37,13 +45,28 @@ const (
 0
 `
 
-	goldMessagesIE = `432
+	goldMessagesIE = `452
 <html><body>7cca69475363026330a0d99468e88d23ce95e222591126443015f5f462d9a177186c8701fb45a6ffee0daf1a178fc0f58cd309308fba7e6f011ac38c9cdd4580760f1d4560a84d5ca0355ecbbed2ab715a3350fe0c479050640bd0e77acec90c58c4d3dd0f5cf8d4510e68c8b12e087bd88cad349aafd2ab16b07b0b1b8276091217a44a9fe92fedacffff48092ee693af
-<script>try{parent.m('[[0,[\x22c\x22,\x2223sd..32\x22,\x22b\x22,8]],[1,[\x22appMsg1\x22,\x22appMsg2\x22]]]')}catch(e){}</script>
+<script>try{parent.m('[[0,[\u0022c\u0022,\u002223sd..32\u0022,\u0022b\u0022,8]],[1,[\u0022appMsg1\u0022,\u0022appMsg2\u0022]]]')}catch(e){}</script>
 
 42
 <script>try{parent.d()}catch(e){}</script>
 0
+`
+
+	goldMessagesEventStream = `68
+id: 1
+data: [[0,["c","23sd..32","b",8]],[1,["appMsg1","appMsg2"]]]
+
+
+0
+`
+
+	goldLongPoll = `55
+22
+[[0,["c","23sd..32"]]]27
+[[1,["appMsg1","appMsg2"]]]
+0
 `
 
 	goldNonBMPJSLength = `27
@@ -165,6 +188,56 @@ func TestMessagesIE(t *testing.T) {
 	}
 }
 
+func TestMessagesEventStream(t *testing.T) {
+	r := newMockRequest("GET", "/channel?TYPE=eventsource")
+	w := newMockResponse()
+	p := newPadder(w, r)
+	msgs := []*Message{
+		&Message{0, []byte(jsonArray([]interface{}{"c", "23sd..32", "b", 8}))},
+		&Message{1, []byte(jsonArray([]interface{}{"appMsg1", "appMsg2"}))},
+	}
+	p.chunkMessages(msgs)
+	p.end()
+	if !bytes.Equal(w.Raw(), []byte(goldMessagesEventStream)) {
+		t.Errorf("Found %s, want %s", w.Raw(), goldMessagesEventStream)
+	}
+	ct := w.Header().Get("Content-Type")
+	if ct != "text/event-stream; charset=utf-8" {
+		t.Errorf("Found Content-Type %s, want text/event-stream", ct)
+	}
+}
+
+func TestEventStreamLineBreaks(t *testing.T) {
+	r := newMockRequest("GET", "/channel?TYPE=eventsource")
+	w := newMockResponse()
+	p := newPadder(w, r)
+	p.chunk("a\rb\r\nc\nd\r\r\ne")
+	event := "data: a\ndata: b\ndata: c\ndata: d\ndata: \ndata: e\n\n"
+	want := fmt.Sprintf("%d\n%s\n0\n", len(event), event)
+	if string(w.Raw()) != want {
+		t.Errorf("Found %q, want %q", w.Raw(), want)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	r := newMockRequest("GET", "/channel?TYPE=xmlhttp&CI=1")
+	w := newMockResponse()
+	p := newPadder(w, r)
+	p.chunkMessages([]*Message{
+		&Message{0, []byte(jsonArray([]interface{}{"c", "23sd..32"}))},
+	})
+	p.chunkMessages([]*Message{
+		&Message{1, []byte(jsonArray([]interface{}{"appMsg1", "appMsg2"}))},
+	})
+	p.end()
+	if !bytes.Equal(w.Raw(), []byte(goldLongPoll)) {
+		t.Errorf("Found %s, want %s", w.Raw(), goldLongPoll)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "55" {
+		t.Errorf("Found Content-Length %s, want 55", cl)
+	}
+}
+
 func TestNonBMPJSLength(t *testing.T) {
 	r := newMockRequest("GET", "/channel?TYPE=xmlhttp")
 	w := newMockResponse()
@@ -178,3 +251,173 @@ func TestNonBMPJSLength(t *testing.T) {
 		t.Errorf("Found %s, want %s", w.Raw(), goldNonBMPJSLength)
 	}
 }
+
+// decodeLength splits a length prefixed response into its chunks, as the
+// closure client does: the response is decoded as UTF-8 and each length is
+// counted in UTF-16 code units.
+func decodeLength(body []byte) ([]string, error) {
+	units := utf16.Encode([]rune(string(body)))
+	chunks := []string{}
+	for len(units) > 0 {
+		nl := -1
+		for i, u := range units {
+			if u == '\n' {
+				nl = i
+				break
+			}
+		}
+		if nl < 0 {
+			return nil, fmt.Errorf("no length in %q", string(utf16.Decode(units)))
+		}
+		n, err := strconv.Atoi(string(utf16.Decode(units[:nl])))
+		if err != nil || n < 0 || n > len(units)-nl-1 {
+			return nil, fmt.Errorf("invalid length %q", string(
+				utf16.Decode(units[:nl])))
+		}
+		units = units[nl+1:]
+		chunks = append(chunks, string(utf16.Decode(units[:n])))
+		units = units[n:]
+	}
+	return chunks, nil
+}
+
+var scriptMessageRE = regexp.MustCompile(
+	`<script>try\{parent\.m\('([^']*)'\)\}catch\(e\)\{\}</script>\n`)
+
+// decodeScript returns the string literals passed to parent.m() in a script
+// response, failing if a literal contains anything which could end the
+// string or the script element.
+func decodeScript(body []byte) ([]string, error) {
+	msgs := []string{}
+	for _, m := range scriptMessageRE.FindAllSubmatch(body, -1) {
+		lit := string(m[1])
+		if strings.ContainsAny(lit, "<>\"\r\n\u2028\u2029") {
+			return nil, fmt.Errorf("unsafe literal %q", lit)
+		}
+		s, err := unescapeJS(lit)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, s)
+	}
+	return msgs, nil
+}
+
+// unescapeJS decodes the body of a JavaScript string literal.
+func unescapeJS(lit string) (string, error) {
+	units := []uint16{}
+	for i := 0; i < len(lit); {
+		r, size := utf8.DecodeRuneInString(lit[i:])
+		i += size
+		if r != '\\' {
+			units = utf16.AppendRune(units, r)
+			continue
+		}
+		if i == len(lit) {
+			return "", fmt.Errorf("trailing backslash in %q", lit)
+		}
+		c := lit[i]
+		i++
+		switch c {
+		case 'x', 'u':
+			n := 2
+			if c == 'u' {
+				n = 4
+			}
+			if i+n > len(lit) {
+				return "", fmt.Errorf("short escape in %q", lit)
+			}
+			u, err := strconv.ParseUint(lit[i:i+n], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in %q", lit)
+			}
+			units = append(units, uint16(u))
+			i += n
+		case 'n':
+			units = append(units, '\n')
+		case 'r':
+			units = append(units, '\r')
+		case 't':
+			units = append(units, '\t')
+		case 'b':
+			units = append(units, '\b')
+		case 'f':
+			units = append(units, '\f')
+		case 'v':
+			units = append(units, '\v')
+		case '0':
+			units = append(units, 0)
+		default:
+			units = append(units, uint16(c))
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+var paddingSeeds = []string{
+	"",
+	"11111",
+	`[[0,["c","23sd..32","b",8]],[1,["appMsg1","appMsg2"]]]`,
+	"𐀀one𐀀two",
+	"'); alert(1); //",
+	"</script><script>alert(1)</script>",
+	"<!-- \\' \u2028 \u2029 \r\n",
+	"\xff\xe2\x82 \xed\xa0\x80",
+}
+
+func FuzzLengthPadding(f *testing.F) {
+	for _, seed := range paddingSeeds {
+		f.Add(seed, "2")
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		w := httptest.NewRecorder()
+		p := newPadder(w, newMockRequest("GET", "/channel?TYPE=xmlhttp"))
+		p.chunk(a)
+		p.chunk(b)
+		p.end()
+		got, err := decodeLength(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%q: %v", w.Body.String(), err)
+		}
+		want := []string{
+			strings.ToValidUTF8(a, "\uFFFD"),
+			strings.ToValidUTF8(b, "\uFFFD"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("decoded %q, want %q", got, want)
+		}
+	})
+}
+
+func FuzzScriptPadding(f *testing.F) {
+	for _, seed := range paddingSeeds {
+		f.Add(seed, "example.com")
+	}
+	f.Fuzz(func(t *testing.T, msg, domain string) {
+		w := httptest.NewRecorder()
+		r := newMockRequest("GET", "/channel?TYPE=html&DOMAIN="+
+			url.QueryEscape(domain))
+		p := newPadder(w, r)
+		p.chunk(msg)
+		p.end()
+		body := w.Body.Bytes()
+		got, err := decodeScript(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{strings.ToValidUTF8(msg, "\uFFFD")}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("decoded %q, want %q", got, want)
+		}
+		// Nothing else may open a script element: the start (with the
+		// document.domain script), the message and the end.
+		scripts := 2
+		if domain != "" {
+			scripts++
+		}
+		n := bytes.Count(bytes.ToLower(body), []byte("<script"))
+		if n != scripts {
+			t.Errorf("%d script elements, want %d in %q", n, scripts, body)
+		}
+	})
+}
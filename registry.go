@@ -0,0 +1,171 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// registryShards is the number of independently locked partitions of the
+// session registry.
+const registryShards = 64
+
+// sessionRegistry maps SIDs to the sessions active on a Server. It is
+// partitioned into shards (by SID hash) so that requests for different
+// sessions rarely contend, and no application code is invoked while a shard
+// is locked.
+type sessionRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mutex    sync.Mutex
+	sessions map[string]*sessionWrapper
+	// lookups holds the in-flight LookupSession calls, which concurrent
+	// requests for the same SID wait for rather than repeating.
+	lookups map[string]*sessionLookup
+}
+
+// sessionLookup is the result of a LookupSession call, available once done
+// is closed.
+type sessionLookup struct {
+	done chan struct{}
+	sw   *sessionWrapper
+	err  error
+}
+
+func newSessionRegistry() *sessionRegistry {
+	reg := &sessionRegistry{}
+	for i := range reg.shards {
+		reg.shards[i].sessions = make(map[string]*sessionWrapper)
+		reg.shards[i].lookups = make(map[string]*sessionLookup)
+	}
+	return reg
+}
+
+func (reg *sessionRegistry) shard(sid string) *registryShard {
+	h := fnv.New32a()
+	io.WriteString(h, sid)
+	return &reg.shards[h.Sum32()%registryShards]
+}
+
+// get returns the active session sid.
+func (reg *sessionRegistry) get(sid string) (*sessionWrapper, bool) {
+	shard := reg.shard(sid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	sw, ok := shard.sessions[sid]
+	return sw, ok
+}
+
+// remove removes sw, unless it has already been replaced by another session
+// with the same SID.
+func (reg *sessionRegistry) remove(sw *sessionWrapper) {
+	shard := reg.shard(sw.SID())
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.sessions[sw.SID()] == sw {
+		delete(shard.sessions, sw.SID())
+	}
+}
+
+// all returns the active sessions.
+func (reg *sessionRegistry) all() []*sessionWrapper {
+	sessions := []*sessionWrapper{}
+	for i := range reg.shards {
+		shard := &reg.shards[i]
+		shard.mutex.Lock()
+		for _, sw := range shard.sessions {
+			sessions = append(sessions, sw)
+		}
+		shard.mutex.Unlock()
+	}
+	return sessions
+}
+
+// add registers the newly created session sw and starts processing it. If
+// the Server has begun shutting down the session is terminated instead and
+// ErrServerShutdown is returned.
+func (s *Server) add(sw *sessionWrapper) error {
+	shard := s.sessions.shard(sw.SID())
+	shard.mutex.Lock()
+	if s.shuttingDown.Load() {
+		shard.mutex.Unlock()
+		err := s.sm.TerminatedSession(sw.Session, ServerShutdownTermination)
+		if err != nil {
+			s.sm.Error(nil, err)
+		}
+		closeSession(s, sw.Session)
+		return ErrServerShutdown
+	}
+	shard.sessions[sw.SID()] = sw
+	shard.mutex.Unlock()
+	launchSession(sw)
+	return nil
+}
+
+// lookup returns the session sid, resuming it with LookupSession if it is not
+// active. Concurrent lookups of the same SID share a single LookupSession
+// call.
+func (s *Server) lookup(r *http.Request, sid string) (*sessionWrapper, error) {
+	shard := s.sessions.shard(sid)
+	shard.mutex.Lock()
+	if sw, ok := shard.sessions[sid]; ok {
+		shard.mutex.Unlock()
+		return sw, nil
+	}
+	if s.shuttingDown.Load() {
+		shard.mutex.Unlock()
+		return nil, ErrServerShutdown
+	}
+	if l, ok := shard.lookups[sid]; ok {
+		shard.mutex.Unlock()
+		<-l.done
+		return l.sw, l.err
+	}
+	l := &sessionLookup{done: make(chan struct{})}
+	shard.lookups[sid] = l
+	shard.mutex.Unlock()
+	defer close(l.done)
+
+	session, si, err := s.sm.LookupSession(r, sid)
+	if err != nil {
+		shard.mutex.Lock()
+		delete(shard.lookups, sid)
+		shard.mutex.Unlock()
+		l.err = err
+		return nil, err
+	}
+	sw := newSessionWrapper(s, session)
+	sw.si = si
+
+	shard.mutex.Lock()
+	delete(shard.lookups, sid)
+	if s.shuttingDown.Load() {
+		shard.mutex.Unlock()
+		// The session remains in the application's storage to be resumed
+		// elsewhere.
+		closeSession(s, session)
+		l.err = ErrServerShutdown
+		return nil, l.err
+	}
+	shard.sessions[sid] = sw
+	shard.mutex.Unlock()
+	launchSession(sw)
+	l.sw = sw
+	return sw, nil
+}
+
+// closeSession closes a session which was never launched.
+func closeSession(s *Server, session Session) {
+	if c, ok := session.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.sm.Error(nil, err)
+		}
+	}
+}
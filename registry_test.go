@@ -0,0 +1,78 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lookupSessionManager resumes every SID once release is closed.
+type lookupSessionManager struct {
+	testSessionManager
+	release chan struct{}
+	lookups atomic.Int32
+}
+
+func (sm *lookupSessionManager) LookupSession(r *http.Request, sid string) (
+	Session,
+	*SessionInfo,
+	error,
+) {
+	sm.lookups.Add(1)
+	<-sm.release
+	return NewMemorySession(sid, nil), &SessionInfo{-1, -1}, nil
+}
+
+func TestRegistryLookupDedupe(t *testing.T) {
+	sm := &lookupSessionManager{release: make(chan struct{})}
+	srv := NewServer(sm, nil)
+
+	// A slow LookupSession does not block other sessions.
+	newReq := httptest.NewRequest("POST", "/", nil)
+	if _, err := srv.newSession(newReq); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	sessions := make([]*sessionWrapper, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/?SID=resumed", nil)
+			sw, err := srv.getSession(r)
+			if err != nil {
+				t.Error(err)
+			}
+			sessions[i] = sw
+		}(i)
+	}
+	for sm.lookups.Load() == 0 {
+		runtime.Gosched()
+	}
+	if _, err := srv.newSession(newReq); err != nil {
+		t.Fatal(err)
+	}
+	close(sm.release)
+	wg.Wait()
+
+	if got := sm.lookups.Load(); got != 1 {
+		t.Errorf("LookupSession called %d times, want 1", got)
+	}
+	for _, sw := range sessions {
+		if sw != sessions[0] {
+			t.Fatalf("Found different sessions %p and %p", sw, sessions[0])
+		}
+	}
+	if got := len(srv.sessions.all()); got != 3 {
+		t.Errorf("Found %d sessions, want 3", got)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// restartRequest asks the worker of an old session to hand over its un-ACKed
+// back channel messages and terminate.
+type restartRequest struct {
+	r    *http.Request
+	aid  int
+	msgs []*Message
+	err  error
+	done chan struct{}
+}
+
+// errRestartForbidden is returned when the request restarting a session is
+// not authenticated for the old session.
+var errRestartForbidden = errors.New("wc: Session restart not authenticated")
+
+// restartMessages ACKs the back channel messages of session up to and
+// including aid and returns the remaining messages, except for those whose
+// IDs are in internal.
+func restartMessages(
+	session Session,
+	aid int,
+	internal map[int]struct{},
+) ([]*Message, error) {
+	bcMsgs, err := session.BackChannelPeek()
+	if err != nil {
+		return nil, err
+	}
+	msgs := []*Message{}
+	messagesToACK := false
+	for _, bcMsg := range bcMsgs {
+		_, isInternal := internal[bcMsg.ID]
+		switch {
+		case bcMsg.ID <= aid:
+			messagesToACK = true
+		case !isInternal:
+			msgs = append(msgs, bcMsg)
+		}
+	}
+	if messagesToACK {
+		if err := session.BackChannelACKThrough(aid); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// restartSession is invoked from the sessionWorker of the old session.
+func restartSession(sw *sessionWrapper, rr *restartRequest) {
+	sw.debug(rr.r, "wc: session restart", "aid", rr.aid)
+	defer close(rr.done)
+
+	if !sw.Authenticated(rr.r) {
+		rr.err = errRestartForbidden
+		return
+	}
+	rr.msgs, rr.err = restartMessages(sw.Session, rr.aid, sw.internalIDs)
+	if rr.err != nil {
+		return
+	}
+
+	err := sw.srv.sm.TerminatedSession(sw.Session, SessionRestartTermination)
+	if err != nil {
+		sw.srv.sm.Error(rr.r, err)
+	}
+
+	if sw.bc != nil {
+		sw.BackChannelClose()
+		close(sw.bc.done)
+		sw.clearBackChannel()
+	}
+
+	sw.terminate()
+}
+
+// restartSession terminates the session osid and returns its un-ACKed back
+// channel messages, provided r is authenticated for the old session. Sessions
+// not currently known to the server are located with LookupSession. As wc
+// has no record of their internal messages, all of their un-ACKed messages
+// are carried over.
+func (s *Server) restartSession(r *http.Request, osid string, oaid int) (
+	[]*Message,
+	error,
+) {
+	old, hasSession := s.sessions.get(osid)
+	if hasSession {
+		rr := &restartRequest{r: r, aid: oaid, done: make(chan struct{})}
+		select {
+		case old.restartNotifier <- rr:
+			<-rr.done
+			return rr.msgs, rr.err
+		case <-old.done:
+			// Already terminated, there is nothing to carry over.
+			return nil, nil
+		}
+	}
+
+	session, _, err := s.sm.LookupSession(r, osid)
+	if err == ErrUnknownSID {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closeSession(s, session)
+	if !session.Authenticated(r) {
+		return nil, errRestartForbidden
+	}
+	msgs, err := restartMessages(session, oaid, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = s.sm.TerminatedSession(session, SessionRestartTermination)
+	if err != nil {
+		s.sm.Error(r, err)
+	}
+	return msgs, nil
+}
+
+// writeRestartError writes the HTTP error for a failed carryOverMessages.
+func writeRestartError(w http.ResponseWriter, err error) {
+	if err == errRestartForbidden {
+		http.Error(w, "Session restart not authenticated",
+			http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Unable to restart session", http.StatusInternalServerError)
+}
+
+// carryOverMessages adds the un-ACKed back channel messages of the session
+// being restarted (OSID) to the new session.
+func carryOverMessages(sw *sessionWrapper, r *http.Request) error {
+	osid := r.FormValue("OSID")
+	if osid == "" || osid == sw.SID() {
+		return nil
+	}
+	oaid, err := strconv.Atoi(r.FormValue("OAID"))
+	if err != nil {
+		oaid = -1
+	}
+	msgs, err := sw.srv.restartSession(r, osid, oaid)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		sw.debug(r, "wc: carrying over message", "id", msg.ID,
+			bodyAttr(msg.Body), "osid", osid)
+		if err := sw.BackChannelAdd(msg.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// closerSession counts calls to Close.
+type closerSession struct {
+	*MemorySession
+	closes *atomic.Int32
+}
+
+func (s closerSession) Close() error {
+	s.closes.Add(1)
+	return nil
+}
+
+// storedSessionManager resumes the session stored with LookupSession.
+type storedSessionManager struct {
+	testSessionManager
+	stored  *MemorySession
+	lookups atomic.Int32
+	closes  atomic.Int32
+}
+
+func (sm *storedSessionManager) LookupSession(r *http.Request, sid string) (
+	Session,
+	*SessionInfo,
+	error,
+) {
+	if sid != sm.stored.SID() {
+		return nil, nil, ErrUnknownSID
+	}
+	sm.lookups.Add(1)
+	return closerSession{sm.stored, &sm.closes}, &SessionInfo{-1, -1}, nil
+}
+
+// create posts a create request with the parameters query, returning the
+// status code and the messages of the response.
+func create(t *testing.T, url, query string, header http.Header) (
+	int,
+	[]*Message,
+) {
+	t.Helper()
+	r, err := http.NewRequest("POST", url+"/bind?VER=8&RID=1&CVER=8&"+query,
+		strings.NewReader("count=0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = header.Clone()
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	chunk, err := readLengthChunk(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := decodeMessages(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, msgs
+}
+
+// bodies returns the bodies of msgs.
+func bodies(msgs []*Message) []string {
+	b := []string{}
+	for _, msg := range msgs {
+		b = append(b, string(msg.Body))
+	}
+	return b
+}
+
+func TestRestartInternalMessages(t *testing.T) {
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	_, url := newTestServer(t, sm, nil)
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+	if err := sm.session("1").Send([]byte(`"a"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the create message nor "a" has been ACKed, but only "a" is
+	// carried over.
+	code, msgs := create(t, url, "OSID=1&OAID=-1", nil)
+	if code != http.StatusOK {
+		t.Fatalf("restart status %d", code)
+	}
+	if len(msgs) != 2 || !strings.HasPrefix(string(msgs[0].Body), `["c","2"`) ||
+		string(msgs[1].Body) != `"a"` {
+		t.Errorf("restart messages %s, want create and \"a\"", bodies(msgs))
+	}
+	if reason := <-sm.terminated; reason != SessionRestartTermination {
+		t.Errorf("TerminatedSession reason = %v", reason)
+	}
+}
+
+func TestRestartLookupSession(t *testing.T) {
+	sm := &storedSessionManager{
+		testSessionManager: testSessionManager{
+			terminated: make(chan TerminationReason, 1),
+		},
+		stored: NewMemorySession("stored", nil),
+	}
+	sm.stored.AuthFunc = func(r *http.Request) bool {
+		return r.Header.Get("X-User") == "alice"
+	}
+	if err := sm.stored.BackChannelAdd([]byte(`"a"`)); err != nil {
+		t.Fatal(err)
+	}
+	_, url := newTestServer(t, sm, nil)
+
+	code, _ := create(t, url, "OSID=stored&OAID=-1",
+		http.Header{"X-User": {"mallory"}})
+	if code != http.StatusForbidden {
+		t.Errorf("restart by another user status %d, want 403", code)
+	}
+	if msgs, _ := sm.stored.BackChannelPeek(); len(msgs) != 1 {
+		t.Errorf("stored session has %d messages, want 1", len(msgs))
+	}
+	select {
+	case reason := <-sm.terminated:
+		t.Errorf("stored session terminated (%v)", reason)
+	default:
+	}
+
+	code, msgs := create(t, url, "OSID=stored&OAID=-1",
+		http.Header{"X-User": {"alice"}})
+	if code != http.StatusOK {
+		t.Fatalf("restart status %d", code)
+	}
+	if len(msgs) != 2 || string(msgs[1].Body) != `"a"` {
+		t.Errorf("restart messages %s, want create and \"a\"", bodies(msgs))
+	}
+	if reason := <-sm.terminated; reason != SessionRestartTermination {
+		t.Errorf("TerminatedSession reason = %v", reason)
+	}
+	lookups, closes := sm.lookups.Load(), sm.closes.Load()
+	if lookups == 0 || closes != lookups {
+		t.Errorf("%d sessions looked up, %d closed", lookups, closes)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRPCTimeout limits RPC.Call when its context has no deadline.
+	defaultRPCTimeout = 30 * time.Second
+	// defaultRPCConcurrentCalls limits the running calls from each client.
+	defaultRPCConcurrentCalls = 16
+)
+
+// ErrRPCTimeout is returned by RPC.Call when the client does not respond in
+// time.
+var ErrRPCTimeout = errors.New("wc: RPC timed out")
+
+// RPCSession is a Session which can queue application messages on its back
+// channel. MemorySession, FileSession and SQLSession implement it.
+type RPCSession interface {
+	Session
+	Send(messageBody []byte) error
+	Done() <-chan struct{}
+}
+
+// RPCHandler handles a call made by the client. params is the JSON encoded
+// parameters (null when omitted). The returned result is JSON encoded for
+// the response; a returned *RPCError is sent to the client as is, and any
+// other error is sent as an RPCError with its message. A panic is logged and
+// sent as an RPCError with the message "internal error".
+type RPCHandler func(ctx context.Context, params json.RawMessage) (
+	interface{},
+	error,
+)
+
+// RPCError is an error response to a call.
+type RPCError struct {
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return "wc: RPC error: " + e.Message
+}
+
+// RPC layers request/response calls on top of sessions, in both directions.
+//
+// Calls from the client are forward channel messages with the fields
+//
+//	rpc=call, id=<client chosen ID>, method=<name>, params=<JSON>
+//
+// and are answered on the back channel with one of
+//
+//	{"rpc":"result","id":"<ID>","result":<JSON>}
+//	{"rpc":"error","id":"<ID>","error":{"message":"..."}}
+//
+// Calls from the server (see Call) are back channel messages
+//
+//	{"rpc":"call","id":"<ID>","method":"<name>","params":<JSON>}
+//
+// which the client answers with forward channel messages with the fields
+// rpc=result, id and result=<JSON>, or rpc=error, id and error=<message>.
+//
+// Applications pass their forward channel messages through ForwardChannel,
+// which handles the RPC messages and returns the others. The "rpc" field is
+// reserved: every forward channel message in which it is set is handled as
+// an RPC message (and dropped if it is not one), so application messages
+// must not use it.
+type RPC struct {
+	// Timeout limits Call when its context has no deadline. The default is 30
+	// seconds.
+	Timeout time.Duration
+
+	// MaxConcurrentCalls limits the calls from each session's client which
+	// run at once. Calls beyond the limit are answered with an RPCError with
+	// the message "too many concurrent calls". The default is 16.
+	MaxConcurrentCalls int
+
+	// Logger receives invalid RPC messages and failures to queue responses.
+	// When nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	mutex    sync.RWMutex
+	handlers map[string]RPCHandler
+	// pending holds the calls made by Call awaiting a response, by ID.
+	pending map[string]*rpcCall
+	nextID  atomic.Int64
+	// running counts the calls from the client being served, by SID.
+	running map[string]int
+}
+
+// rpcCall is a server initiated call awaiting its response.
+type rpcCall struct {
+	sid  string
+	done chan *rpcMessage
+}
+
+// rpcMessage is the back channel encoding of RPC messages.
+type rpcMessage struct {
+	RPC    string          `json:"rpc"`
+	ID     string          `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+type rpcSessionKey struct{}
+
+// RPCSessionFromContext returns the session of a call, from the context passed
+// to an RPCHandler.
+func RPCSessionFromContext(ctx context.Context) (RPCSession, bool) {
+	s, ok := ctx.Value(rpcSessionKey{}).(RPCSession)
+	return s, ok
+}
+
+// NewRPC creates an RPC with no handlers.
+func NewRPC() *RPC {
+	return &RPC{
+		handlers: make(map[string]RPCHandler),
+		pending:  make(map[string]*rpcCall),
+		running:  make(map[string]int),
+	}
+}
+
+// Handle registers h for calls to method, replacing any previous handler.
+func (rpc *RPC) Handle(method string, h RPCHandler) {
+	rpc.mutex.Lock()
+	defer rpc.mutex.Unlock()
+	rpc.handlers[method] = h
+}
+
+func (rpc *RPC) logger() *slog.Logger {
+	if rpc.Logger == nil {
+		return slog.Default()
+	}
+	return rpc.Logger
+}
+
+// ForwardChannel handles the RPC messages in msgs and returns the remaining
+// messages for the application. It is intended to be called from
+// Session.ForwardChannel() (or a ForwardChannelFunc).
+//
+// Each call runs its handler in a new goroutine (up to MaxConcurrentCalls at
+// once for s), with a context which carries s and is canceled when s is
+// terminated, so handlers may block (or make calls to the client with Call)
+// without stalling the session.
+func (rpc *RPC) ForwardChannel(s RPCSession, msgs []*Message) []*Message {
+	rest := []*Message{}
+	for _, msg := range msgs {
+		var fields map[string]string
+		if json.Unmarshal(msg.Body, &fields) != nil || fields["rpc"] == "" {
+			rest = append(rest, msg)
+			continue
+		}
+		switch fields["rpc"] {
+		case "call":
+			rpc.call(s, fields)
+		case "result", "error":
+			rpc.respond(s, fields)
+		default:
+			rpc.logger().Error("wc: invalid RPC message", "sid", s.SID(),
+				bodyAttr(msg.Body))
+		}
+	}
+	return rest
+}
+
+// call starts serving a call from the client, unless MaxConcurrentCalls of
+// the session's calls are already running.
+func (rpc *RPC) call(s RPCSession, fields map[string]string) {
+	id := fields["id"]
+	if id == "" {
+		rpc.logger().Error("wc: RPC call without id", "sid", s.SID(),
+			"method", fields["method"])
+		return
+	}
+	limit := rpc.MaxConcurrentCalls
+	if limit <= 0 {
+		limit = defaultRPCConcurrentCalls
+	}
+	sid := s.SID()
+	rpc.mutex.Lock()
+	ok := rpc.running[sid] < limit
+	if ok {
+		rpc.running[sid]++
+	}
+	rpc.mutex.Unlock()
+	if !ok {
+		rpc.send(s, &rpcMessage{
+			RPC:   "error",
+			ID:    id,
+			Error: &RPCError{"too many concurrent calls"},
+		})
+		return
+	}
+	go func() {
+		resp := rpc.serve(s, id, fields)
+		// The call is complete before the client can see its response.
+		rpc.mutex.Lock()
+		rpc.running[sid]--
+		if rpc.running[sid] == 0 {
+			delete(rpc.running, sid)
+		}
+		rpc.mutex.Unlock()
+		rpc.send(s, resp)
+	}()
+}
+
+// serve runs the handler of call id from the client and returns its response.
+func (rpc *RPC) serve(
+	s RPCSession,
+	id string,
+	fields map[string]string,
+) *rpcMessage {
+	rpc.mutex.RLock()
+	h, ok := rpc.handlers[fields["method"]]
+	rpc.mutex.RUnlock()
+
+	resp := &rpcMessage{RPC: "result", ID: id}
+	var result interface{}
+	var err error
+	params := json.RawMessage(fields["params"])
+	switch {
+	case !ok:
+		err = &RPCError{"unknown method " + strconv.Quote(fields["method"])}
+	case len(params) > 0 && !json.Valid(params):
+		err = &RPCError{"invalid params"}
+	default:
+		if len(params) == 0 {
+			params = json.RawMessage("null")
+		}
+		ctx, cancel := context.WithCancel(
+			context.WithValue(context.Background(), rpcSessionKey{}, s))
+		go func() {
+			select {
+			case <-s.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		result, err = rpc.invoke(ctx, s, fields["method"], h, params)
+		cancel()
+	}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		resp.RPC = "error"
+		resp.Result = nil
+		if resp.Error, ok = err.(*RPCError); !ok {
+			resp.Error = &RPCError{err.Error()}
+		}
+	}
+	return resp
+}
+
+// invoke runs the handler h of method, converting a panic into an error.
+func (rpc *RPC) invoke(
+	ctx context.Context,
+	s RPCSession,
+	method string,
+	h RPCHandler,
+	params json.RawMessage,
+) (result interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			rpc.logger().Error("wc: RPC handler panic", "sid", s.SID(),
+				"method", method, "panic", v, "stack", string(debug.Stack()))
+			result, err = nil, &RPCError{"internal error"}
+		}
+	}()
+	return h(ctx, params)
+}
+
+func (rpc *RPC) send(s RPCSession, msg *rpcMessage) error {
+	body, err := json.Marshal(msg)
+	if err == nil {
+		err = s.Send(body)
+	}
+	if err != nil && err != ErrSessionTerminated {
+		rpc.logger().Error("wc: unable to send RPC message", "sid", s.SID(),
+			"id", msg.ID, "error", err)
+	}
+	return err
+}
+
+// respond delivers the client's response to a call made by Call.
+func (rpc *RPC) respond(s RPCSession, fields map[string]string) {
+	rpc.mutex.Lock()
+	call, ok := rpc.pending[fields["id"]]
+	if ok && call.sid == s.SID() {
+		delete(rpc.pending, fields["id"])
+	} else {
+		ok = false
+	}
+	rpc.mutex.Unlock()
+	if !ok {
+		// Unknown, or the call has already timed out.
+		return
+	}
+
+	resp := &rpcMessage{RPC: fields["rpc"], ID: fields["id"]}
+	switch {
+	case resp.RPC == "error":
+		resp.Error = &RPCError{fields["error"]}
+	case fields["result"] == "":
+		resp.Result = json.RawMessage("null")
+	default:
+		resp.Result = json.RawMessage(fields["result"])
+	}
+	call.done <- resp
+}
+
+// Call calls method on the client of session s and decodes the result into
+// result (unless result is nil). When ctx has no deadline the call is
+// limited to Timeout, after which ErrRPCTimeout is returned. An error
+// response from the client is returned as an *RPCError. ErrSessionTerminated
+// is returned if s is terminated before the client responds.
+func (rpc *RPC) Call(
+	ctx context.Context,
+	s RPCSession,
+	method string,
+	params interface{},
+	result interface{},
+) error {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := rpc.Timeout
+		if timeout <= 0 {
+			timeout = defaultRPCTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, ErrRPCTimeout)
+		defer cancel()
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	// The "s" prefix keeps server IDs distinct from client IDs in logs.
+	id := "s" + strconv.FormatInt(rpc.nextID.Add(1), 10)
+	call := &rpcCall{sid: s.SID(), done: make(chan *rpcMessage, 1)}
+	rpc.mutex.Lock()
+	rpc.pending[id] = call
+	rpc.mutex.Unlock()
+	defer func() {
+		rpc.mutex.Lock()
+		delete(rpc.pending, id)
+		rpc.mutex.Unlock()
+	}()
+
+	msg := &rpcMessage{RPC: "call", ID: id, Method: method, Params: encoded}
+	if err := rpc.send(s, msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-call.done:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("wc: unable to decode RPC result: %v", err)
+		}
+		return nil
+	case <-s.Done():
+		return ErrSessionTerminated
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); cause == ErrRPCTimeout {
+			return ErrRPCTimeout
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newRPCTest(t *testing.T) (*Server, *RPC, *MemorySession, *Client) {
+	rpc := NewRPC()
+	// Messages other than RPC messages are echoed.
+	forward := func(s *MemorySession, msgs []*Message) error {
+		return echo(s, rpc.ForwardChannel(s, msgs))
+	}
+	sm := &testSessionManager{forward: forward}
+	srv, url := newTestServer(t, sm, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, &ClientOptions{SkipTest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return srv, rpc, sm.session(c.SID()), c
+}
+
+// receiveRPC returns the next back channel message decoded as an rpcMessage.
+func receiveRPC(t *testing.T, c *Client) *rpcMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := c.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &rpcMessage{}
+	if err := json.Unmarshal(msg.Body, resp); err != nil {
+		t.Fatalf("%s: %v", msg.Body, err)
+	}
+	return resp
+}
+
+func TestRPCClientCalls(t *testing.T) {
+	_, rpc, _, c := newRPCTest(t)
+	rpc.Handle("add", func(ctx context.Context, params json.RawMessage) (
+		interface{},
+		error,
+	) {
+		var args []int
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		sum := 0
+		for _, arg := range args {
+			sum += arg
+		}
+		return sum, nil
+	})
+	rpc.Handle("sid", func(ctx context.Context, params json.RawMessage) (
+		interface{},
+		error,
+	) {
+		s, ok := RPCSessionFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no session")
+		}
+		return s.SID(), nil
+	})
+	rpc.Handle("fail", func(ctx context.Context, params json.RawMessage) (
+		interface{},
+		error,
+	) {
+		return nil, &RPCError{"failed"}
+	})
+	rpc.Handle("panic", func(ctx context.Context, params json.RawMessage) (
+		interface{},
+		error,
+	) {
+		panic("boom")
+	})
+
+	tests := []struct {
+		call map[string]string
+		want string
+	}{
+		{map[string]string{"method": "add", "params": "[1,2,3]"},
+			`{"rpc":"result","id":"1","result":6}`},
+		{map[string]string{"method": "sid"},
+			`{"rpc":"result","id":"1","result":"1"}`},
+		{map[string]string{"method": "fail"},
+			`{"rpc":"error","id":"1","error":{"message":"failed"}}`},
+		{map[string]string{"method": "panic"},
+			`{"rpc":"error","id":"1","error":{"message":"internal error"}}`},
+		{map[string]string{"method": "add", "params": "[1,"},
+			`{"rpc":"error","id":"1","error":{"message":"invalid params"}}`},
+		{map[string]string{"method": "nope"}, `{"rpc":"error","id":"1",` +
+			`"error":{"message":"unknown method \"nope\""}}`},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		test.call["rpc"] = "call"
+		test.call["id"] = "1"
+		// Non-RPC messages are passed through to the application.
+		if err := c.Send(ctx, test.call, map[string]string{"a": "b"}); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			msg, err := c.Receive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[string(msg.Body)] = true
+		}
+		if !got[test.want] || !got[`{"a":"b"}`] {
+			t.Errorf("%v: got %v, want %s", test.call, got, test.want)
+		}
+	}
+}
+
+func TestRPCConcurrentCalls(t *testing.T) {
+	_, rpc, _, c := newRPCTest(t)
+	rpc.MaxConcurrentCalls = 1
+	release := make(chan struct{})
+	rpc.Handle("wait", func(ctx context.Context, params json.RawMessage) (
+		interface{},
+		error,
+	) {
+		<-release
+		return nil, nil
+	})
+	ctx := context.Background()
+	call := func(id string) map[string]string {
+		return map[string]string{"rpc": "call", "id": id, "method": "wait"}
+	}
+
+	if err := c.Send(ctx, call("1"), call("2")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := receiveRPC(t, c); resp.ID != "2" || resp.Error == nil ||
+		resp.Error.Message != "too many concurrent calls" {
+		t.Errorf("call over the limit = %+v, want an error", resp)
+	}
+	close(release)
+	if resp := receiveRPC(t, c); resp.ID != "1" || resp.RPC != "result" {
+		t.Errorf("call = %+v, want a result", resp)
+	}
+	// The completed call no longer counts towards the limit.
+	if err := c.Send(ctx, call("3")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := receiveRPC(t, c); resp.ID != "3" || resp.RPC != "result" {
+		t.Errorf("call = %+v, want a result", resp)
+	}
+}
+
+func TestRPCServerCalls(t *testing.T) {
+	srv, rpc, s, c := newRPCTest(t)
+	ctx := context.Background()
+
+	type callResult struct {
+		result string
+		err    error
+	}
+	call := func() chan callResult {
+		done := make(chan callResult, 1)
+		go func() {
+			var result string
+			err := rpc.Call(ctx, s, "ping", map[string]int{"x": 1}, &result)
+			done <- callResult{result, err}
+		}()
+		return done
+	}
+
+	// A result.
+	done := call()
+	req := receiveRPC(t, c)
+	if req.RPC != "call" || req.Method != "ping" ||
+		string(req.Params) != `{"x":1}` {
+		t.Errorf("call = %+v", req)
+	}
+	err := c.Send(ctx, map[string]string{
+		"rpc":    "result",
+		"id":     req.ID,
+		"result": `"pong"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.err != nil || res.result != "pong" {
+		t.Errorf("Call = %q %v, want pong", res.result, res.err)
+	}
+
+	// An error.
+	done = call()
+	req = receiveRPC(t, c)
+	err = c.Send(ctx, map[string]string{
+		"rpc":   "error",
+		"id":    req.ID,
+		"error": "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if rerr, ok := res.err.(*RPCError); !ok || rerr.Message != "no" {
+		t.Errorf("Call = %v, want RPCError no", res.err)
+	}
+
+	// A timeout, after which the response is ignored.
+	rpc.Timeout = 10 * time.Millisecond
+	done = call()
+	req = receiveRPC(t, c)
+	if res := <-done; res.err != ErrRPCTimeout {
+		t.Errorf("Call = %v, want ErrRPCTimeout", res.err)
+	}
+	err = c.Send(ctx, map[string]string{"rpc": "result", "id": req.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Termination of the session.
+	rpc.Timeout = 0
+	done = call()
+	receiveRPC(t, c)
+	if err := srv.TerminateSession(ctx, s.SID()); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.err != ErrSessionTerminated {
+		t.Errorf("Call = %v, want ErrSessionTerminated", res.err)
+	}
+}
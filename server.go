@@ -0,0 +1,178 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultNoopInterval        = 30 * time.Second
+	defaultBackChannelLifetime = 4 * time.Minute
+	defaultStopTimeout         = time.Minute
+)
+
+// Options configures a Server. The zero value provides the defaults, which
+// are suitable for most applications.
+type Options struct {
+	// NoopInterval is the period after which a noop message is written to an
+	// otherwise idle back channel. It should be shorter than the idle timeout
+	// of any proxies or load balancers between the client and server. The
+	// default is 30 seconds.
+	NoopInterval time.Duration
+
+	// LongPollTimeout is the maximum period a long polling (buffered proxy,
+	// CI=1) back channel is held open while no messages are pending. When it
+	// expires a noop is delivered, completing the poll. The default is
+	// NoopInterval.
+	LongPollTimeout time.Duration
+
+	// BackChannelLifetime is the maximum period a single back channel request
+	// is held open before it is closed (and reopened by the client). The
+	// default is 4 minutes.
+	BackChannelLifetime time.Duration
+
+	// Jitter shortens each NoopInterval and BackChannelLifetime by a random
+	// duration of up to Jitter, so that the configured values are never
+	// exceeded while noops and reconnects of many sessions are spread out.
+	// The default is no jitter.
+	Jitter time.Duration
+
+	// IdleTimeout is the period after which a session with neither an open
+	// back channel nor any forward channel requests is terminated with
+	// IdleTimeoutTermination. Zero (the default) disables idle termination,
+	// leaving session timeouts to the application (see ServerTerminate).
+	IdleTimeout time.Duration
+
+	// StopTimeout is the maximum period a session terminated by ServerTerminate
+	// waits for a back channel to deliver the stop message on before the
+	// termination completes. The default is 1 minute.
+	StopTimeout time.Duration
+
+	// DebugHistory is the number of recent debug messages retained for each
+	// session and reported by SessionStatus and DebugHandler, whether or not
+	// Logger has debug logging enabled. The messages include message bodies.
+	// Zero (the default) retains none.
+	DebugHistory int
+
+	// Metrics receives the Server's counters and gauges. The default publishes
+	// them with expvar as "wc" (shared by all Servers using the default). It
+	// cannot be overridden by SessionOptions.
+	Metrics Metrics
+
+	// Logger receives wc's debug logging at slog.LevelDebug, with the session
+	// ID ("sid") and other details as attributes. When logging on behalf of a
+	// request, the request's context is passed to the slog.Handler. The
+	// default is slog.Default(). It cannot be overridden by SessionOptions.
+	Logger *slog.Logger
+}
+
+// SessionOptions may optionally be implemented by a Session to override the
+// Server's Options for that session (for example, a longer NoopInterval for
+// mobile clients). Zero valued fields of the returned Options use the
+// Server's value.
+type SessionOptions interface {
+	Options() *Options
+}
+
+// merge returns o with the non-zero fields of override applied.
+func (o Options) merge(override *Options) Options {
+	if override == nil {
+		return o
+	}
+	if override.NoopInterval > 0 {
+		o.NoopInterval = override.NoopInterval
+	}
+	if override.LongPollTimeout > 0 {
+		o.LongPollTimeout = override.LongPollTimeout
+	}
+	if override.BackChannelLifetime > 0 {
+		o.BackChannelLifetime = override.BackChannelLifetime
+	}
+	if override.Jitter > 0 {
+		o.Jitter = override.Jitter
+	}
+	if override.IdleTimeout > 0 {
+		o.IdleTimeout = override.IdleTimeout
+	}
+	if override.StopTimeout > 0 {
+		o.StopTimeout = override.StopTimeout
+	}
+	if override.DebugHistory > 0 {
+		o.DebugHistory = override.DebugHistory
+	}
+	return o
+}
+
+// jitter shortens d by a random duration of up to o.Jitter (and never by
+// more than half of d).
+func (o Options) jitter(d time.Duration) time.Duration {
+	j := o.Jitter
+	if j > d/2 {
+		j = d / 2
+	}
+	if j <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(j)))
+}
+
+// Server is a single WebChannel endpoint. Each Server owns its
+// SessionManager and the set of sessions it is currently processing, so
+// multiple independent Servers may be mounted within the same process.
+type Server struct {
+	sm       SessionManager
+	options  Options
+	sessions *sessionRegistry
+	// shuttingDown is set by Shutdown(), after which no sessions are added to
+	// sessions.
+	shuttingDown atomic.Bool
+	// workers tracks the goroutines processing sessions.
+	workers sync.WaitGroup
+	// topics maps each topic to its subscribed sessions (see Publish).
+	topicMutex sync.RWMutex
+	topics     map[string]map[*sessionWrapper]struct{}
+	// drainPeriod is notifierDrainPeriod (shortened by tests).
+	drainPeriod time.Duration
+}
+
+// NewServer creates a Server which delegates application level session
+// handling to sm. A nil opts uses the default Options.
+func NewServer(sm SessionManager, opts *Options) *Server {
+	if sm == nil {
+		panic("No SessionManager provided")
+	}
+	s := &Server{
+		sm: sm,
+		options: Options{
+			NoopInterval:        defaultNoopInterval,
+			BackChannelLifetime: defaultBackChannelLifetime,
+			StopTimeout:         defaultStopTimeout,
+		}.merge(opts),
+		sessions:    newSessionRegistry(),
+		topics:      make(map[string]map[*sessionWrapper]struct{}),
+		drainPeriod: notifierDrainPeriod,
+	}
+	if opts != nil && opts.Metrics != nil {
+		s.options.Metrics = opts.Metrics
+	} else {
+		s.options.Metrics = expvarMetrics()
+	}
+	if opts != nil && opts.Logger != nil {
+		s.options.Logger = opts.Logger
+	} else {
+		s.options.Logger = slog.Default()
+	}
+	return s
+}
+
+// SessionManager returns the SessionManager supplied to NewServer.
+func (s *Server) SessionManager() SessionManager {
+	return s.sm
+}
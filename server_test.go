@@ -0,0 +1,195 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSessionManager creates MemorySessions with sequential SIDs, passing
+// their forward channel messages to forward (when set). The reason of each
+// termination is sent on terminated (when set).
+type testSessionManager struct {
+	DefaultSessionManager
+	forward    ForwardChannelFunc
+	hostPrefix string
+	terminated chan TerminationReason
+
+	mutex    sync.Mutex
+	next     int
+	sessions map[string]*MemorySession
+}
+
+func (sm *testSessionManager) NewSession(r *http.Request) (Session, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.next++
+	s := NewMemorySession(strconv.Itoa(sm.next), sm.forward)
+	if sm.sessions == nil {
+		sm.sessions = make(map[string]*MemorySession)
+	}
+	sm.sessions[s.SID()] = s
+	return s, nil
+}
+
+// session returns the active session sid, or nil.
+func (sm *testSessionManager) session(sid string) *MemorySession {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.sessions[sid]
+}
+
+func (sm *testSessionManager) TerminatedSession(
+	s Session,
+	reason TerminationReason,
+) error {
+	sm.mutex.Lock()
+	delete(sm.sessions, s.SID())
+	sm.mutex.Unlock()
+	if sm.terminated != nil {
+		sm.terminated <- reason
+	}
+	return nil
+}
+
+func (sm *testSessionManager) HostPrefix() string {
+	return sm.hostPrefix
+}
+
+// echo sends each forward channel message back on the back channel.
+func echo(s *MemorySession, msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := s.Send(msg.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTestServer creates a Server for sm with TestHandler and BindHandler
+// installed under /channel of an httptest.Server, which is closed when t
+// completes. The URL of the channel is returned.
+func newTestServer(
+	t *testing.T,
+	sm SessionManager,
+	opts *Options,
+) (*Server, string) {
+	srv := NewServer(sm, opts)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channel/test", srv.TestHandler)
+	mux.HandleFunc("/channel/bind", srv.BindHandler)
+	hs := httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+	return srv, hs.URL + "/channel"
+}
+
+func TestOptionsMerge(t *testing.T) {
+	o := Options{
+		NoopInterval:        defaultNoopInterval,
+		BackChannelLifetime: defaultBackChannelLifetime,
+		Jitter:              time.Second,
+	}.merge(&Options{NoopInterval: 50 * time.Second})
+	want := Options{
+		NoopInterval:        50 * time.Second,
+		BackChannelLifetime: defaultBackChannelLifetime,
+		Jitter:              time.Second,
+	}
+	if o != want {
+		t.Errorf("Found %+v, want %+v", o, want)
+	}
+}
+
+func TestOptionsJitter(t *testing.T) {
+	o := Options{Jitter: 10 * time.Second}
+	for i := 0; i < 100; i++ {
+		d := o.jitter(30 * time.Second)
+		if d > 30*time.Second || d <= 20*time.Second {
+			t.Fatalf("Found %v, want (20s, 30s]", d)
+		}
+	}
+	if d := o.jitter(4 * time.Second); d <= 2*time.Second {
+		t.Errorf("Found %v, want jitter limited to half the interval", d)
+	}
+	if d := (Options{}).jitter(time.Second); d != time.Second {
+		t.Errorf("Found %v, want %v", d, time.Second)
+	}
+}
+
+func TestServersIndependent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sms := []*testSessionManager{
+		{forward: echo, terminated: make(chan TerminationReason, 1)},
+		{forward: echo, terminated: make(chan TerminationReason, 1)},
+	}
+	srvs := []*Server{}
+	clients := []*Client{}
+	for _, sm := range sms {
+		srv, url := newTestServer(t, sm, nil)
+		c, err := Dial(ctx, url, &ClientOptions{SkipTest: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		srvs = append(srvs, srv)
+		clients = append(clients, c)
+	}
+
+	// Each Server numbers its own sessions, so both have session "1".
+	for i, srv := range srvs {
+		if srv.SessionManager() != sms[i] {
+			t.Errorf("Server %d has the SessionManager of another Server", i)
+		}
+		if got := srv.SessionIDs(); len(got) != 1 || got[0] != "1" {
+			t.Errorf("Server %d SessionIDs = %v, want [1]", i, got)
+		}
+	}
+	for i, c := range clients {
+		body := strconv.Itoa(i)
+		if err := c.Send(ctx, map[string]string{"server": body}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"server":"` + body + `"}`; string(msg.Body) != want {
+			t.Errorf("client %d received %s, want %s", i, msg.Body, want)
+		}
+	}
+
+	// Terminating session "1" of the first Server leaves the second intact.
+	if err := srvs[0].TerminateSession(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if reason := <-sms[0].terminated; reason != ServerTerminateRequest {
+		t.Errorf("TerminatedSession reason = %v, want ServerTerminateRequest",
+			reason)
+	}
+	if got := srvs[0].SessionIDs(); len(got) != 0 {
+		t.Errorf("terminated Server SessionIDs = %v, want none", got)
+	}
+	select {
+	case reason := <-sms[1].terminated:
+		t.Errorf("second Server terminated its session (%v)", reason)
+	default:
+	}
+	if _, err := srvs[1].SessionStatus(ctx, "1"); err != nil {
+		t.Errorf("second Server SessionStatus = %v", err)
+	}
+	if err := clients[1].Send(ctx, map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := clients[1].Receive(ctx); err != nil ||
+		string(msg.Body) != `{"a":"b"}` {
+		t.Errorf("Receive = %v %v, want {\"a\":\"b\"}", msg, err)
+	}
+}
@@ -27,114 +27,206 @@ func flushPending(sw *sessionWrapper) error {
 		return nil
 	}
 	for _, msg := range msgs {
-		debug("wc: %s writing back channel message %d %s", sw.SID(), msg.ID,
-			msg.Body)
+		sw.debug(sw.bc.r, "wc: writing back channel message", "id", msg.ID,
+			bodyAttr(msg.Body))
 	}
 	sw.si.BackChannelAID = msgs[len(msgs)-1].ID
 	err = sw.p.chunkMessages(msgs)
 	if err != nil {
 		return err
 	}
-	if sw.bc.r.FormValue("CI") == "1" {
-		// TODO(hochhaus): Do not write messages in chunked mode when the back
-		// channel is a buffered proxy. Just reply to the entire request at once.
-		debug("wc: %s closing buffered-proxy back channel to deliver messages",
-			sw.SID())
-		sw.p.end()
-		sw.BackChannelClose()
-		close(sw.bc.done)
-		sw.bc = nil
-		sw.p = nil
-		sw.backChannelCloseNotifier = nil
-		sw.noopTimer.Stop()
-		sw.longBackChannelTimer.Stop()
+	sw.srv.metric(MetricBackChannelMessages, int64(len(msgs)))
+	sw.srv.metric(MetricBackChannelBytes, int64(messageBytes(msgs)))
+	if sw.stopID >= 0 && sw.si.BackChannelAID >= sw.stopID {
+		sw.stopDelivered = true
+	}
+	switch {
+	case sw.p.buffered:
+		sw.srv.metric(MetricBufferedProxyCloses, 1)
+		// Long polling (buffered proxy) back channels deliver a single batch of
+		// messages per request.
+		sw.debug(sw.bc.r,
+			"wc: closing buffered-proxy back channel to deliver messages")
+	case sw.stopDelivered:
+		sw.debug(sw.bc.r, "wc: closing back channel after delivering stop")
+	default:
+		return nil
 	}
+	sw.p.end()
+	sw.BackChannelClose()
+	close(sw.bc.done)
+	sw.clearBackChannel()
 	return nil
 }
 
 func noop(sw *sessionWrapper) {
 	if sw.bc == nil {
-		debug("wc: %s noop skipped", sw.SID())
+		sw.debug(nil, "wc: noop skipped")
 		return
 	}
 
 	// if a non-buffered, active backchannel w/o pending data add noop
-	debug("wc: %s noop", sw.SID())
-	sw.noopTimer.Reset(30 * time.Second)
+	sw.debug(sw.bc.r, "wc: noop")
+	sw.resetNoopTimer()
 
-	if err := sw.BackChannelAdd([]byte("[\"noop\"]")); err != nil {
-		sm.Error(sw.bc.r, err)
+	if _, err := sw.addInternal([]byte("[\"noop\"]")); err != nil {
+		sw.srv.sm.Error(sw.bc.r, err)
 		return
 	}
 	sw.backChannelBytes += 8
+	sw.srv.metric(MetricNoops, 1)
 	if err := flushPending(sw); err != nil {
-		sm.Error(sw.bc.r, err)
+		sw.srv.sm.Error(sw.bc.r, err)
+	}
+	if sw.bc != nil && sw.bc.ws != nil {
+		// The pong resets the read deadline of the WebSocket.
+		sw.bc.ws.writeFrame(wsPing, nil)
 	}
 }
 
 func longBackChannel(sw *sessionWrapper) {
 	if sw.bc != nil {
-		debug("wc: %s closing long-lived back channel", sw.SID())
+		sw.debug(sw.bc.r, "wc: closing long-lived back channel")
 		sw.p.end()
 		sw.BackChannelClose()
 		close(sw.bc.done)
 	}
-	sw.bc = nil
-	sw.p = nil
-	sw.backChannelCloseNotifier = nil
-	sw.noopTimer.Stop()
-	sw.longBackChannelTimer.Stop()
+	sw.clearBackChannel()
 }
 
 func backChannelClose(sw *sessionWrapper) {
 	if sw.bc != nil {
-		debug("wc: %s back channel closed", sw.SID())
+		sw.debug(sw.bc.r, "wc: back channel closed")
 		sw.BackChannelClose()
 		close(sw.bc.done)
 	}
-	sw.bc = nil
-	sw.p = nil
-	sw.backChannelCloseNotifier = nil
-	sw.noopTimer.Stop()
-	sw.longBackChannelTimer.Stop()
+	sw.clearBackChannel()
 }
 
 func backChannel(sw *sessionWrapper, reqRequest *reqRegister) {
-	debug("wc: %s new back channel", sw.SID())
+	sw.debug(reqRequest.r, "wc: new back channel")
 	if !maybeACKBackChannel(sw, reqRequest.w, reqRequest.r, false) {
-		close(sw.bc.done)
+		close(reqRequest.done)
 		return
 	}
 
 	if sw.bc != nil {
 		sw.BackChannelClose()
-		sm.Error(reqRequest.r, errors.New("Duplicate backchannel."))
+		sw.srv.sm.Error(reqRequest.r, errors.New("Duplicate backchannel."))
 		close(sw.bc.done)
 	}
+	if sw.bc == nil {
+		sw.srv.metric(MetricBackChannels, 1)
+	}
 	sw.bc = reqRequest
 	sw.p = newPadder(reqRequest.w, reqRequest.r)
-	cn, ok := reqRequest.w.(http.CloseNotifier)
-	if !ok {
-		panic("webserver doesn't support close notification")
-	}
-	sw.backChannelCloseNotifier = cn.CloseNotify()
-	sw.noopTimer.Reset(30 * time.Second)
-	sw.longBackChannelTimer.Reset(4 * 60 * time.Second)
+	sw.backChannelCloseNotifier = reqRequest.r.Context().Done()
+	sw.resetNoopTimer()
+	sw.resetLongBackChannelTimer()
 	sw.BackChannelOpen()
 	if err := flushPending(sw); err != nil {
-		sm.Error(sw.bc.r, err)
+		sw.srv.sm.Error(sw.bc.r, err)
+	}
+}
+
+// serverTerminate is invoked from sessionWorker for ServerTerminate.
+func serverTerminate(sw *sessionWrapper) {
+	sw.debug(sw.request(), "wc: server terminate session")
+	stopSession(sw, ServerTerminateRequest, sw.options.StopTimeout)
+}
+
+// stopSession queues a stop message on the back channel. The session is
+// terminated with reason once the stop has been written to a back channel (or
+// ACKed by the client), or after timeout; a zero timeout terminates it as
+// soon as the stop has been written to the open back channel (if any). When
+// no back channel is open the stop is announced by the pending byte count in
+// the next forward channel reply, prompting the client to open a back
+// channel.
+func stopSession(
+	sw *sessionWrapper,
+	reason TerminationReason,
+	timeout time.Duration,
+) {
+	if sw.stopID >= 0 {
+		// Already terminating, which may now have to complete sooner.
+		if timeout <= 0 {
+			finishServerTerminate(sw)
+		} else if time.Until(sw.stopTimer.deadline) > timeout {
+			sw.stopTimer.Stop()
+			sw.stopTimer.Reset(timeout)
+		}
+		return
+	}
+	sw.stopReason = reason
+	stop := []byte(jsonArray([]interface{}{"stop"}))
+	stopID, err := sw.addInternal(stop)
+	if err != nil {
+		sw.srv.sm.Error(sw.request(), err)
+		finishServerTerminate(sw)
+		return
+	}
+
+	sw.stopID = stopID
+	sw.backChannelBytes += len(stop)
+	sw.idleTimer.Stop()
+	if sw.bc != nil {
+		if err := flushPending(sw); err != nil {
+			sw.srv.sm.Error(sw.request(), err)
+		}
+	}
+	if timeout <= 0 {
+		finishServerTerminate(sw)
+		return
+	}
+	sw.stopTimer.Reset(timeout)
+}
+
+// finishServerTerminate completes stopSession once the stop message has been
+// delivered or has timed out.
+func finishServerTerminate(sw *sessionWrapper) {
+	sw.debug(sw.request(), "wc: server terminated session")
+	if sw.stopReason == ServerTerminateRequest {
+		sw.srv.metric(MetricServerTerminations, 1)
+	}
+	err := sw.srv.sm.TerminatedSession(sw.Session, sw.stopReason)
+	if err != nil {
+		sw.srv.sm.Error(sw.request(), err)
+	}
+	if sw.bc != nil {
+		sw.p.end()
+		sw.BackChannelClose()
+		close(sw.bc.done)
+		sw.clearBackChannel()
+	}
+	sw.terminate()
+}
+
+func idleTimeout(sw *sessionWrapper) {
+	if sw.options.IdleTimeout <= 0 {
+		return
+	}
+	if time.Since(sw.lastActivity()) < sw.options.IdleTimeout {
+		sw.resetIdleTimer()
+		return
+	}
+	sw.debug(nil, "wc: idle session timeout")
+	err := sw.srv.sm.TerminatedSession(sw.Session, IdleTimeoutTermination)
+	if err != nil {
+		sw.srv.sm.Error(nil, err)
 	}
+	sw.terminate()
 }
 
 func clientTerminate(sw *sessionWrapper, reqRequest *reqRegister) {
-	debug("wc: %s client terminate session", sw.SID())
+	sw.debug(reqRequest.r, "wc: client terminate session")
 	defer func() {
 		reqRequest.done <- struct{}{}
 	}()
 
-	err := sm.TerminatedSession(sw.Session, ClientTerminateRequest)
+	sw.srv.metric(MetricClientTerminations, 1)
+	err := sw.srv.sm.TerminatedSession(sw.Session, ClientTerminateRequest)
 	if err != nil {
-		sm.Error(reqRequest.r, err)
+		sw.srv.sm.Error(reqRequest.r, err)
 		http.Error(reqRequest.w, "Unable to terminate",
 			http.StatusInternalServerError)
 		return
@@ -143,24 +235,34 @@ func clientTerminate(sw *sessionWrapper, reqRequest *reqRegister) {
 	if sw.bc != nil {
 		sw.BackChannelClose()
 		close(sw.bc.done)
-		sw.bc = nil
-		sw.p = nil
-		sw.backChannelCloseNotifier = nil
-		sw.noopTimer.Stop()
-		sw.longBackChannelTimer.Stop()
+		sw.clearBackChannel()
 	}
 
-	mutex.Lock()
-	delete(sessionWrapperMap, sw.SID())
-	mutex.Unlock()
+	sw.terminate()
 
 	reqRequest.w.Write([]byte("Terminated"))
 }
 
+func isBackChannel(r *http.Request) bool {
+	switch r.FormValue("TYPE") {
+	case "xmlhttp", "html", "eventsource":
+		return true
+	}
+	return false
+}
+
 func launchSession(sw *sessionWrapper) {
 	activityNotifier := make(chan int)
-	go sessionWorker(sw, activityNotifier)
-	go activityProxyWorker(sw, activityNotifier)
+	sw.srv.metric(MetricSessions, 1)
+	sw.srv.workers.Add(2)
+	go func() {
+		defer sw.srv.workers.Done()
+		sessionWorker(sw, activityNotifier)
+	}()
+	go func() {
+		defer sw.srv.workers.Done()
+		activityProxyWorker(sw, activityNotifier)
+	}()
 }
 
 func maybeACKBackChannel(
@@ -170,16 +272,44 @@ func maybeACKBackChannel(
 	forwardChannel bool,
 ) bool {
 	aid, err := strconv.Atoi(r.FormValue("AID"))
-	if err != nil || aid < 0 {
-		sm.Error(r, err)
+	if err == nil && aid < 0 {
+		err = fmt.Errorf("wc: invalid AID %d", aid)
+	}
+	if err != nil {
+		sw.srv.sm.Error(r, err)
 		http.Error(w, "Unable to parse AID", 400)
 		return false
 	}
+	if !forwardChannel && r.FormValue("TYPE") == "eventsource" {
+		// A reconnecting EventSource reuses the AID from its original URL, so
+		// prefer the ID of the last event it received.
+		if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil &&
+			lastID > aid {
+			aid = lastID
+		}
+	}
+	if status, err := ackBackChannel(sw, aid, forwardChannel); err != nil {
+		sw.srv.sm.Error(r, err)
+		switch status {
+		case http.StatusInternalServerError:
+			http.Error(w, "Unable to get messages", status)
+		default:
+			http.Error(w, "Unable to ACK back channel up to AID", status)
+		}
+		return false
+	}
+	return true
+}
+
+// ackBackChannel ACKs all back channel messages up to and including aid. On
+// failure the HTTP status code appropriate for the error is returned.
+func ackBackChannel(sw *sessionWrapper, aid int, forwardChannel bool) (
+	int,
+	error,
+) {
 	bcMsgs, err := sw.BackChannelPeek()
 	if err != nil {
-		sm.Error(r, err)
-		http.Error(w, "Unable to get messages", http.StatusInternalServerError)
-		return false
+		return http.StatusInternalServerError, err
 	}
 	remainingBytes := 0
 	ackedBytes := 0
@@ -198,15 +328,14 @@ func maybeACKBackChannel(
 			sw.si.BackChannelAID = aid
 			sw.backChannelBytes = remainingBytes
 		}
-		return true
+		return http.StatusOK, nil
 	}
 
 	err = sw.BackChannelACKThrough(aid)
 	if err != nil {
-		sm.Error(r, err)
-		http.Error(w, "Unable to ACK back channel up to AID", 400)
-		return false
+		return 400, err
 	}
+	sw.ackInternal(aid)
 	if forwardChannel {
 		// Do not trigger retransmit on the current back channel
 		sw.backChannelBytes -= ackedBytes
@@ -215,27 +344,29 @@ func maybeACKBackChannel(
 		sw.si.BackChannelAID = aid
 		sw.backChannelBytes = remainingBytes
 	}
-	debug("wc: %s ACKed back channel %d bytes up to AID %d", sw.SID(),
-		ackedBytes, aid)
-	return true
+	sw.debug(nil, "wc: ACKed back channel", "bytes", ackedBytes, "aid", aid)
+	if sw.stopID >= 0 && aid >= sw.stopID {
+		sw.stopDelivered = true
+	}
+	return http.StatusOK, nil
 }
 
 func activityProxyWorker(sw *sessionWrapper, activityNotifier chan int) {
 	var an chan int
 	var proxiedByteCount int
 	for {
-		// TODO(hochhaus): shutdown activityProxyWorker when the corresponding
-		// session has been terminated.
 		select {
+		case <-sw.done:
+			return
 		case i := <-sw.DataNotifier():
-			debug("wc: %s new back channel data %d bytes (proxied)", sw.SID(), i)
+			sw.debug(nil, "wc: new back channel data (proxied)", "bytes", i)
 			proxiedByteCount += i
 			if proxiedByteCount > 0 {
 				an = activityNotifier
 			}
 		case an <- proxiedByteCount:
-			debug("wc: %s new back channel data %d bytes (non-proxied)", sw.SID(),
-				proxiedByteCount)
+			sw.debug(nil, "wc: new back channel data (non-proxied)",
+				"bytes", proxiedByteCount)
 			proxiedByteCount = 0
 			an = nil
 		}
@@ -244,6 +375,17 @@ func activityProxyWorker(sw *sessionWrapper, activityNotifier chan int) {
 
 func sessionWorker(sw *sessionWrapper, activityNotifier chan int) {
 	for {
+		select {
+		case <-sw.done:
+			sw.debug(nil, "wc: session worker exiting")
+			return
+		default:
+		}
+		if sw.stopDelivered {
+			finishServerTerminate(sw)
+			continue
+		}
+
 		select {
 		case <-sw.noopTimer.C:
 			noop(sw)
@@ -251,10 +393,17 @@ func sessionWorker(sw *sessionWrapper, activityNotifier chan int) {
 			longBackChannel(sw)
 		case <-sw.backChannelCloseNotifier:
 			backChannelClose(sw)
+		case <-sw.idleTimer.C:
+			idleTimeout(sw)
 		case reqRequest := <-sw.reqNotifier:
+			if !reqRequest.webSocket && !isBackChannel(reqRequest.r) {
+				sw.lastForwardChannel = time.Now()
+				sw.resetIdleTimer()
+			}
 			switch {
-			case reqRequest.r.FormValue("TYPE") == "xmlhttp" ||
-				reqRequest.r.FormValue("TYPE") == "html":
+			case reqRequest.webSocket:
+				webSocket(sw, reqRequest)
+			case isBackChannel(reqRequest.r):
 				backChannel(sw, reqRequest)
 			case reqRequest.r.FormValue("TYPE") == "terminate":
 				clientTerminate(sw, reqRequest)
@@ -264,42 +413,44 @@ func sessionWorker(sw *sessionWrapper, activityNotifier chan int) {
 				fcHandler(sw, reqRequest)
 			}
 
+		case m := <-sw.wsNotifier:
+			sw.lastForwardChannel = time.Now()
+			wsForwardChannel(sw, m)
+
+		case rr := <-sw.restartNotifier:
+			restartSession(sw, rr)
+
+		case sr := <-sw.shutdownNotifier:
+			shutdownSession(sw, sr)
+
+		case <-sw.publishNotifier:
+			publish(sw)
+
+		case ar := <-sw.adminNotifier:
+			if ar.ctx.Err() == nil {
+				ar.f(sw)
+			}
+			close(ar.done)
+
+		case <-sw.stopTimer.C:
+			sw.debug(nil, "wc: stop was not delivered")
+			finishServerTerminate(sw)
+
 		case sa := <-sw.Notifier():
 			switch {
 			case sa == ServerTerminate:
-				debug("wc: %s server terminate session", sw.SID(), sa)
-				err := sm.TerminatedSession(sw.Session, ServerTerminateRequest)
-				if err != nil {
-					sm.Error(sw.bc.r, err)
-				}
-				if sw.bc != nil {
-					// TODO(hochhaus): persist the session termination until the client
-					// ACKs it?
-					msgs := []*Message{
-						&Message{0, []byte(jsonArray([]interface{}{"stop"}))},
-					}
-					sw.p.chunkMessages(msgs)
-					sw.p.end()
-					sw.BackChannelClose()
-					close(sw.bc.done)
-					sw.bc = nil
-					sw.p = nil
-					sw.backChannelCloseNotifier = nil
-					sw.noopTimer.Stop()
-					sw.longBackChannelTimer.Stop()
-				}
-				break
+				serverTerminate(sw)
 			default:
 				panic(fmt.Sprintf("Unsupported SessionActivity: %d", sa))
 			}
 
 		case sa := <-activityNotifier:
-			debug("wc: %s new back channel data %d bytes", sw.SID(), sa)
+			sw.debug(sw.request(), "wc: new back channel data", "bytes", sa)
 			// BackChannelActivity
 			sw.backChannelBytes += sa
 			if sw.bc != nil {
 				if err := flushPending(sw); err != nil {
-					sm.Error(sw.bc.r, err)
+					sw.srv.sm.Error(sw.bc.r, err)
 				}
 			}
 		}
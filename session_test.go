@@ -0,0 +1,454 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent returns the id and data lines of the next event of an event
+// stream.
+func readEvent(t *testing.T, br *bufio.Reader) (string, []string) {
+	t.Helper()
+	id := ""
+	data := []string{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if id != "" || len(data) > 0 {
+				return id, data
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestEventStreamResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sm := &testSessionManager{}
+	srv, url := newTestServer(t, sm, nil)
+
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+	s := sm.session("1")
+	if s == nil {
+		t.Fatal("session 1 not created")
+	}
+	for _, body := range []string{`"a"`, `"b"`} {
+		if err := s.Send([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// backChannel opens an EventSource back channel with the original AID=0,
+	// sending lastEventID as the Last-Event-ID header (when set).
+	backChannel := func(
+		lastEventID string,
+	) (*http.Response, context.CancelFunc) {
+		bcCtx, bcCancel := context.WithCancel(ctx)
+		r, err := http.NewRequestWithContext(bcCtx, "GET",
+			url+"/bind?VER=8&RID=rpc&SID=1&CI=0&AID=0&TYPE=eventsource", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			r.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, bcCancel
+	}
+
+	resp, bcCancel := backChannel("")
+	id, data := readEvent(t, bufio.NewReader(resp.Body))
+	if id != "2" || len(data) != 1 || data[0] != `[[1,"a"],[2,"b"]]` {
+		t.Errorf("Found event %s %q, want 2 [[1,\"a\"],[2,\"b\"]]", id, data)
+	}
+	bcCancel()
+	resp.Body.Close()
+	for {
+		status, err := srv.SessionStatus(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.BackChannel {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Send([]byte(`"c"`)); err != nil {
+		t.Fatal(err)
+	}
+	// The reconnecting EventSource still requests AID=0, but Last-Event-ID
+	// ACKs the events it already received.
+	resp, bcCancel = backChannel("2")
+	defer bcCancel()
+	defer resp.Body.Close()
+	id, data = readEvent(t, bufio.NewReader(resp.Body))
+	if id != "3" || len(data) != 1 || data[0] != `[[3,"c"]]` {
+		t.Errorf("Found event %s %q, want 3 [[3,\"c\"]]", id, data)
+	}
+}
+
+// openBackChannel opens a streaming back channel for session sid, ACKing
+// through message 0, and waits for the server to register it. The response
+// body is sent on the returned chan once the back channel ends.
+func openBackChannel(
+	ctx context.Context,
+	t *testing.T,
+	srv *Server,
+	url string,
+	sid string,
+) <-chan string {
+	t.Helper()
+	r, err := http.NewRequestWithContext(ctx, "GET",
+		url+"/bind?VER=8&RID=rpc&CI=0&AID=0&TYPE=xmlhttp&SID="+sid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			body <- ""
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	for {
+		status, err := srv.SessionStatus(ctx, sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.BackChannel {
+			return body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// forward posts a forward channel request with the form body to session sid.
+func forward(t *testing.T, url, sid, body string) {
+	t.Helper()
+	resp, err := http.Post(url+"/bind?VER=8&RID=2&AID=0&SID="+sid,
+		"application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("forward channel status %d", resp.StatusCode)
+	}
+}
+
+// expectIdleTimeout waits for the session of sm to be terminated, no
+// earlier than idle after since.
+func expectIdleTimeout(
+	t *testing.T,
+	sm *testSessionManager,
+	since time.Time,
+	idle time.Duration,
+) {
+	t.Helper()
+	select {
+	case reason := <-sm.terminated:
+		if reason != IdleTimeoutTermination {
+			t.Errorf("TerminatedSession reason = %v, want IdleTimeoutTermination",
+				reason)
+		}
+		if d := time.Since(since); d < idle {
+			t.Errorf("session terminated after %v, want at least %v", d, idle)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("session not terminated")
+	}
+}
+
+// expectActive fails if the session of sm has been terminated.
+func expectActive(t *testing.T, sm *testSessionManager) {
+	t.Helper()
+	select {
+	case reason := <-sm.terminated:
+		t.Fatalf("active session terminated (%v)", reason)
+	default:
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	_, url := newTestServer(t, sm, &Options{IdleTimeout: idle})
+	start := time.Now()
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+	expectIdleTimeout(t, sm, start, idle)
+}
+
+func TestIdleTimeoutDisabled(t *testing.T) {
+	srv := NewServer(&testSessionManager{}, nil)
+	sw := newSessionWrapper(srv, NewMemorySession("1", nil))
+	if due := sw.idleTimer.due(); !due.IsZero() {
+		t.Errorf("idle timer due at %v, want stopped", due)
+	}
+	select {
+	case <-sw.idleTimer.C:
+		t.Error("disabled idle timer fired")
+	case <-time.After(10 * time.Millisecond):
+	}
+	idleTimeout(sw)
+	select {
+	case <-sw.done:
+		t.Error("session terminated with IdleTimeout disabled")
+	default:
+	}
+}
+
+func TestIdleTimeoutForwardChannel(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	_, url := newTestServer(t, sm, &Options{IdleTimeout: idle})
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+
+	// Each forward channel request restarts the timeout.
+	var last time.Time
+	for i := 0; i < 6; i++ {
+		time.Sleep(idle / 2)
+		last = time.Now()
+		forward(t, url, "1", "count=0")
+	}
+	expectActive(t, sm)
+	expectIdleTimeout(t, sm, last, idle)
+}
+
+func TestIdleTimeoutBackChannel(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	srv, url := newTestServer(t, sm, &Options{IdleTimeout: idle})
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+
+	// The session is active for as long as a back channel is open.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	openBackChannel(ctx, t, srv, url, "1")
+	time.Sleep(3 * idle)
+	expectActive(t, sm)
+
+	// Closing the back channel restarts the timeout.
+	closed := time.Now()
+	cancel()
+	expectIdleTimeout(t, sm, closed, idle)
+}
+
+func TestDefaultSessionZeroValue(t *testing.T) {
+	var s DefaultSession
+	go func() {
+		<-s.Notifier()
+	}()
+	if err := s.Notify(ServerTerminate); err != nil {
+		t.Errorf("Notify = %v", err)
+	}
+	s.Close()
+	if err := s.Notify(ServerTerminate); err != ErrSessionTerminated {
+		t.Errorf("Notify after Close = %v, want ErrSessionTerminated", err)
+	}
+	if err := s.NotifyData(1); err != ErrSessionTerminated {
+		t.Errorf("NotifyData after Close = %v, want ErrSessionTerminated", err)
+	}
+}
+
+func TestSessionTerminationCleanup(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	srv := NewServer(sm, &Options{
+		StopTimeout: 10 * time.Millisecond,
+		IdleTimeout: time.Minute,
+	})
+	srv.drainPeriod = 50 * time.Millisecond
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sm.session(sw.SID())
+	s.Notifier() <- ServerTerminate
+	<-sm.terminated
+	<-sw.done
+
+	// Sends made directly on the notifiers do not block.
+	select {
+	case s.Notifier() <- ServerTerminate:
+	case <-time.After(time.Second):
+		t.Error("Notifier() blocked after termination")
+	}
+	select {
+	case s.DataNotifier() <- 1:
+	case <-time.After(time.Second):
+		t.Error("DataNotifier() blocked after termination")
+	}
+
+	timers := map[string]*deadlineTimer{
+		"noop":            sw.noopTimer,
+		"longBackChannel": sw.longBackChannelTimer,
+		"idle":            sw.idleTimer,
+		"stop":            sw.stopTimer,
+	}
+	for name, timer := range timers {
+		if timer.Stop() {
+			t.Errorf("%s timer running after termination", name)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines after termination, want %d",
+				runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackChannelContextCanceled(t *testing.T) {
+	sm := &testSessionManager{}
+	srv := NewServer(sm, nil)
+	sw, err := srv.newSession(httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.BackChannelAdd([]byte(`"a"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ResponseRecorder is not an http.CloseNotifier, so the back channel
+	// can only notice the disconnect through the request context.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest("GET",
+		"/channel/bind?VER=8&RID=rpc&CI=0&AID=0&TYPE=xmlhttp&SID="+sw.SID(),
+		nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := NewGZIPResponseWriter(httptest.NewRecorder(), r)
+		defer w.Close()
+		srv.BindHandler(w, r)
+	}()
+	for {
+		status, err := srv.SessionStatus(ctx, sw.SID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.BackChannel {
+			break
+		}
+		select {
+		case <-done:
+			t.Fatal("back channel request failed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("back channel not closed after the request was canceled")
+	}
+	status, err := srv.SessionStatus(context.Background(), sw.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.BackChannel {
+		t.Error("session still has a back channel")
+	}
+}
+
+func TestServerTerminateDelivered(t *testing.T) {
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	srv, url := newTestServer(t, sm, nil)
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := openBackChannel(ctx, t, srv, url, "1")
+
+	// The client does not ACK the stop, so the session is terminated once the
+	// stop has been written rather than after the (1 minute) StopTimeout.
+	if err := sm.session("1").Notify(ServerTerminate); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-sm.terminated:
+		if reason != ServerTerminateRequest {
+			t.Errorf("TerminatedSession reason = %v, want ServerTerminateRequest",
+				reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not terminated")
+	}
+	if b := <-body; !strings.Contains(b, `[1,["stop"]]`) {
+		t.Errorf("back channel %q has no stop message", b)
+	}
+}
+
+func TestServerTerminateIdleTimeout(t *testing.T) {
+	const stopTimeout = 300 * time.Millisecond
+	sm := &testSessionManager{terminated: make(chan TerminationReason, 1)}
+	_, url := newTestServer(t, sm, &Options{
+		IdleTimeout: 50 * time.Millisecond,
+		StopTimeout: stopTimeout,
+	})
+	if code, _ := create(t, url, "", nil); code != http.StatusOK {
+		t.Fatalf("create status %d", code)
+	}
+
+	// Without a back channel the stop is not delivered, and the idle timeout
+	// does not cut the StopTimeout short.
+	start := time.Now()
+	if err := sm.session("1").Notify(ServerTerminate); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-sm.terminated:
+		if reason != ServerTerminateRequest {
+			t.Errorf("TerminatedSession reason = %v, want ServerTerminateRequest",
+				reason)
+		}
+		if d := time.Since(start); d < stopTimeout {
+			t.Errorf("session terminated after %v, want at least %v", d,
+				stopTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not terminated")
+	}
+}
@@ -5,6 +5,12 @@
 package wc
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -24,43 +30,300 @@ import (
 // Tasks for application level:
 // * sharding comet server? (moving sessions across servers?)
 // * restart server without dropping back channels
-// * expvar stats: # sessions, # backchannels, # pending messages, etc
-
-var (
-	mutex             sync.Mutex
-	sessionWrapperMap map[string]*sessionWrapper
-)
-
-func init() {
-	sessionWrapperMap = make(map[string]*sessionWrapper)
-}
 
 type sessionWrapper struct {
 	Session
+	srv                             *Server
+	options                         Options
 	si                              *SessionInfo
 	reqNotifier                     chan *reqRegister
-	noopTimer, longBackChannelTimer *time.Timer
+	wsNotifier                      chan *wsMessage
+	restartNotifier                 chan *restartRequest
+	shutdownNotifier                chan *shutdownRequest
+	adminNotifier                   chan *adminRequest
+	noopTimer, longBackChannelTimer *deadlineTimer
+	idleTimer                       *deadlineTimer
+	stopTimer                       *deadlineTimer
 	bc                              *reqRegister
-	backChannelCloseNotifier        <-chan bool
+	backChannelCloseNotifier        <-chan struct{}
 	p                               *padder
 	// backChannelBytes is the number of non-ACKed bytes on the back channel
 	// (based upon the last AID received on a back or forward channel)
 	backChannelBytes int
+	// lastForwardChannel and lastBackChannel record the most recent forward
+	// channel request and the most recent time a back channel was open.
+	lastForwardChannel, lastBackChannel time.Time
+	// stopID is the ID of the queued stop message while the session is being
+	// terminated with stopReason (-1 otherwise), and stopDelivered is set once
+	// the stop has been written to a back channel or ACKed by the client.
+	stopID        int
+	stopReason    TerminationReason
+	stopDelivered bool
+	// internalIDs holds the IDs of the un-ACKed internal messages (create,
+	// noop and stop) queued by wc, which are not carried over when the
+	// session is restarted.
+	internalIDs map[int]struct{}
+	// topics is the set of topics the session is subscribed to (guarded by
+	// srv.topicMutex). Published messages are queued in published and
+	// signaled on publishNotifier for the session worker to add.
+	topics          map[string]struct{}
+	publishMutex    sync.Mutex
+	published       [][]byte
+	publishNotifier chan struct{}
+	// logger is Options.Logger with the session's ID, and debugLog holds the
+	// session's recent debug messages (see Options.DebugHistory).
+	logger   *slog.Logger
+	debugLog debugRing
+	// done is closed once the session has been terminated, stopping the
+	// session's goroutines.
+	done chan struct{}
 }
 
-func newSessionWrapper(session Session) *sessionWrapper {
+func newSessionWrapper(srv *Server, session Session) *sessionWrapper {
+	options := srv.options
+	if so, ok := session.(SessionOptions); ok {
+		options = options.merge(so.Options())
+	}
 	sw := &sessionWrapper{
-		Session:              session,
-		si:                   &SessionInfo{-1, -1},
-		reqNotifier:          make(chan *reqRegister),
-		noopTimer:            time.NewTimer(30 * time.Second),
-		longBackChannelTimer: time.NewTimer(4 * 60 * time.Second),
-		bc:                   nil,
+		Session:                  session,
+		srv:                      srv,
+		options:                  options,
+		si:                       &SessionInfo{-1, -1},
+		reqNotifier:              make(chan *reqRegister),
+		wsNotifier:               make(chan *wsMessage),
+		restartNotifier:          make(chan *restartRequest),
+		shutdownNotifier:         make(chan *shutdownRequest),
+		adminNotifier:            make(chan *adminRequest),
+		done:                     make(chan struct{}),
+		noopTimer:                newDeadlineTimer(options.NoopInterval),
+		longBackChannelTimer:     newDeadlineTimer(options.BackChannelLifetime),
+		idleTimer:                newStoppedDeadlineTimer(),
+		stopTimer:                newDeadlineTimer(options.StopTimeout),
+		bc:                       nil,
 		backChannelCloseNotifier: nil,
-		p:                nil,
-		backChannelBytes: 0,
+		p:                        nil,
+		backChannelBytes:         0,
+		lastForwardChannel:       time.Now(),
+		lastBackChannel:          time.Now(),
+		stopID:                   -1,
+		internalIDs:              make(map[int]struct{}),
+		logger:                   options.Logger.With("sid", session.SID()),
+		topics:                   make(map[string]struct{}),
+		publishNotifier:          make(chan struct{}, 1),
 	}
+	sw.debugLog.recs = make([]slog.Record, options.DebugHistory)
 	sw.noopTimer.Stop()
 	sw.longBackChannelTimer.Stop()
+	sw.stopTimer.Stop()
+	if options.IdleTimeout > 0 {
+		sw.idleTimer.Reset(options.IdleTimeout)
+	}
 	return sw
 }
+
+// debug logs msg for the session at slog.LevelDebug with the attributes
+// args (as with slog.Logger.Log). r is the request being processed (or nil),
+// whose context is passed to the slog.Handler. The message is also retained
+// in the session's debug history (see Options.DebugHistory). Nothing is built
+// unless the handler enables slog.LevelDebug or the history is retained.
+func (sw *sessionWrapper) debug(r *http.Request, msg string, args ...any) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	h := sw.logger.Handler()
+	enabled := h.Enabled(ctx, slog.LevelDebug)
+	if !enabled && !sw.debugLog.enabled() {
+		return
+	}
+	rec := slog.NewRecord(time.Now(), slog.LevelDebug, msg, 0)
+	rec.Add(args...)
+	if r != nil {
+		rec.AddAttrs(slog.String("type", requestType(r)))
+	}
+	if sw.debugLog.enabled() {
+		sw.debugLog.add(rec.Clone())
+	}
+	if enabled {
+		h.Handle(ctx, rec)
+	}
+}
+
+// addInternal queues the internal message body on the back channel and
+// returns its ID, which is recorded in internalIDs. Only the session worker
+// removes messages from the queue, so the message is the first with body
+// among those following the messages queued before BackChannelAdd().
+func (sw *sessionWrapper) addInternal(body []byte) (int, error) {
+	before, err := sw.BackChannelPeek()
+	if err != nil {
+		return -1, err
+	}
+	if err := sw.BackChannelAdd(body); err != nil {
+		return -1, err
+	}
+	after, err := sw.BackChannelPeek()
+	if err != nil {
+		return -1, err
+	}
+	if len(after) >= len(before) {
+		for _, msg := range after[len(before):] {
+			if bytes.Equal(msg.Body, body) {
+				sw.internalIDs[msg.ID] = struct{}{}
+				return msg.ID, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("wc: queued message %s not found", body)
+}
+
+// ackInternal forgets the internal messages ACKed through aid.
+func (sw *sessionWrapper) ackInternal(aid int) {
+	for id := range sw.internalIDs {
+		if id <= aid {
+			delete(sw.internalIDs, id)
+		}
+	}
+}
+
+// request returns the current back channel request, or nil if there is no
+// back channel.
+func (sw *sessionWrapper) request() *http.Request {
+	if sw.bc == nil {
+		return nil
+	}
+	return sw.bc.r
+}
+
+// clearBackChannel resets the back channel state once the current back
+// channel has been closed.
+func (sw *sessionWrapper) clearBackChannel() {
+	if sw.bc != nil {
+		sw.srv.metric(MetricBackChannels, -1)
+	}
+	sw.bc = nil
+	sw.p = nil
+	sw.backChannelCloseNotifier = nil
+	sw.noopTimer.Stop()
+	sw.longBackChannelTimer.Stop()
+	sw.lastBackChannel = time.Now()
+	sw.resetIdleTimer()
+}
+
+// resetNoopTimer schedules the next noop on the current back channel. For
+// long polling back channels the noop completes the poll.
+func (sw *sessionWrapper) resetNoopTimer() {
+	interval := sw.options.NoopInterval
+	if sw.p != nil && sw.p.buffered && sw.options.LongPollTimeout > 0 {
+		interval = sw.options.LongPollTimeout
+	}
+	sw.noopTimer.Reset(sw.options.jitter(interval))
+}
+
+// resetLongBackChannelTimer schedules closing the current back channel.
+func (sw *sessionWrapper) resetLongBackChannelTimer() {
+	sw.longBackChannelTimer.Reset(
+		sw.options.jitter(sw.options.BackChannelLifetime))
+}
+
+// lastActivity returns the time of the most recent forward or back channel
+// activity.
+func (sw *sessionWrapper) lastActivity() time.Time {
+	if sw.bc != nil {
+		return time.Now()
+	}
+	if sw.lastBackChannel.After(sw.lastForwardChannel) {
+		return sw.lastBackChannel
+	}
+	return sw.lastForwardChannel
+}
+
+// resetIdleTimer restarts the idle timeout (if enabled) from the most recent
+// forward or back channel activity.
+func (sw *sessionWrapper) resetIdleTimer() {
+	timeout := sw.options.IdleTimeout
+	if timeout <= 0 || sw.stopID >= 0 {
+		// A terminating session is ended by the stop timer instead.
+		return
+	}
+	sw.idleTimer.Stop()
+	sw.idleTimer.Reset(timeout - time.Since(sw.lastActivity()))
+}
+
+// terminate ends processing of the session. It must be invoked from the
+// session worker after the SessionManager has been notified and any back
+// channel has been closed.
+func (sw *sessionWrapper) terminate() {
+	sw.noopTimer.Stop()
+	sw.longBackChannelTimer.Stop()
+	sw.idleTimer.Stop()
+	sw.stopTimer.Stop()
+
+	sw.srv.sessions.remove(sw)
+
+	close(sw.done)
+	sw.srv.metric(MetricSessions, -1)
+	sw.srv.unsubscribeAll(sw)
+	if c, ok := sw.Session.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			sw.srv.sm.Error(nil, err)
+		}
+	}
+	go drainNotifiers(sw.Session, sw.srv.drainPeriod)
+}
+
+// notifierDrainPeriod is how long the Notifier() and DataNotifier() of a
+// terminated session continue to be received (and discarded), so that
+// application code sending on them directly does not block forever.
+const notifierDrainPeriod = time.Minute
+
+// drainNotifiers discards the notifications sent to a terminated session for
+// the period d.
+func drainNotifiers(session Session, d time.Duration) {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-session.Notifier():
+		case <-session.DataNotifier():
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// deadlineTimer is a time.Timer which records when it is due to fire, for
+// reporting by SessionStatus.
+type deadlineTimer struct {
+	*time.Timer
+	deadline time.Time
+}
+
+func newDeadlineTimer(d time.Duration) *deadlineTimer {
+	return &deadlineTimer{time.NewTimer(d), time.Now().Add(d)}
+}
+
+// newStoppedDeadlineTimer creates a deadlineTimer which is not running. Unlike
+// stopping a timer created with a zero duration, it can not have fired.
+func newStoppedDeadlineTimer() *deadlineTimer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return &deadlineTimer{Timer: t}
+}
+
+func (t *deadlineTimer) Reset(d time.Duration) bool {
+	t.deadline = time.Now().Add(d)
+	return t.Timer.Reset(d)
+}
+
+func (t *deadlineTimer) Stop() bool {
+	t.deadline = time.Time{}
+	return t.Timer.Stop()
+}
+
+// due returns when the timer fires, or the zero time if it is not running.
+func (t *deadlineTimer) due() time.Time {
+	if t.deadline.Before(time.Now()) {
+		return time.Time{}
+	}
+	return t.deadline
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// ShutdownPreserver may optionally be implemented by a Session to control how
+// it is handled by Server.Shutdown(). A preserved session has its back
+// channel closed, which the client answers by opening a new back channel
+// (WebSocket back channels are closed with status 1012, service restart).
+// That request resumes the session via SessionManager.LookupSession() on
+// whichever server receives it. Sessions which are not preserved (including
+// all sessions which do not implement ShutdownPreserver) are sent "stop" and
+// terminated with ServerShutdownTermination.
+type ShutdownPreserver interface {
+	PreserveOnShutdown() bool
+}
+
+// shutdownRequest asks a session worker to drain the session after delay.
+// deadline is the deadline of the Shutdown (if any).
+type shutdownRequest struct {
+	delay    time.Duration
+	deadline time.Time
+}
+
+// shutdownSession is invoked from sessionWorker.
+func shutdownSession(sw *sessionWrapper, sr *shutdownRequest) {
+	if sr.delay > 0 {
+		// Wait for the session's slot in the drain period, without blocking the
+		// session worker.
+		go func() {
+			select {
+			case <-time.After(sr.delay):
+				select {
+				case sw.shutdownNotifier <- &shutdownRequest{deadline: sr.deadline}:
+				case <-sw.done:
+				}
+			case <-sw.done:
+			}
+		}()
+		return
+	}
+
+	preserve := false
+	if sp, ok := sw.Session.(ShutdownPreserver); ok {
+		preserve = sp.PreserveOnShutdown()
+	}
+	sw.debug(sw.request(), "wc: shutdown", "preserve", preserve)
+
+	if sw.bc != nil {
+		if err := flushPending(sw); err != nil {
+			sw.srv.sm.Error(sw.bc.r, err)
+		}
+	}
+	if !preserve {
+		// The stop has half of the time remaining to be delivered.
+		timeout := sw.options.StopTimeout
+		if !sr.deadline.IsZero() {
+			if d := time.Until(sr.deadline) / 2; d < timeout {
+				timeout = d
+			}
+		}
+		stopSession(sw, ServerShutdownTermination, timeout)
+		return
+	}
+	if sw.bc != nil {
+		sw.p.end()
+		if sw.bc.ws != nil {
+			sw.bc.ws.writeClose(wsCloseServiceRestart)
+		}
+		sw.BackChannelClose()
+		close(sw.bc.done)
+		sw.clearBackChannel()
+	}
+	sw.terminate()
+}
+
+// Shutdown gracefully shuts down the Server. New sessions are refused and
+// pending messages are flushed on every open back channel before it is closed
+// (see ShutdownPreserver). Sessions which are not preserved are terminated
+// once their stop message has been delivered, or after Options.StopTimeout
+// (or half of the time remaining before the deadline of ctx, if sooner). When
+// ctx has a deadline, back channels are closed at random points during the
+// first half of the time remaining so that clients do not all reconnect at
+// once.
+//
+// Shutdown returns once all session goroutines have exited, or with the error
+// of ctx if it is done first. Shutdown does not close the HTTP server; it
+// should be called prior to http.Server.Shutdown().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	sessions := s.sessions.all()
+
+	var drain time.Duration
+	deadline, ok := ctx.Deadline()
+	if ok {
+		drain = time.Until(deadline) / 2
+	}
+	for _, sw := range sessions {
+		sr := &shutdownRequest{deadline: deadline}
+		if drain > 0 {
+			sr.delay = time.Duration(rand.Int63n(int64(drain)))
+		}
+		select {
+		case sw.shutdownNotifier <- sr:
+		case <-sw.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// preservedSession is preserved by Server.Shutdown.
+type preservedSession struct {
+	*MemorySession
+}
+
+func (s preservedSession) PreserveOnShutdown() bool {
+	return true
+}
+
+// shutdownSessionManager preserves the sessions created with "preserve" set.
+type shutdownSessionManager struct {
+	testSessionManager
+}
+
+func (sm *shutdownSessionManager) NewSession(r *http.Request) (
+	Session,
+	error,
+) {
+	s, err := sm.testSessionManager.NewSession(r)
+	if err != nil || r.FormValue("preserve") == "" {
+		return s, err
+	}
+	return preservedSession{s.(*MemorySession)}, nil
+}
+
+func TestShutdown(t *testing.T) {
+	sm := &shutdownSessionManager{
+		testSessionManager{terminated: make(chan TerminationReason, 3)},
+	}
+	srv, url := newTestServer(t, sm, nil)
+	for _, query := range []string{"", "preserve=1", ""} {
+		if code, _ := create(t, url, query, nil); code != http.StatusOK {
+			t.Fatalf("create status %d", code)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	stopped := openBackChannel(ctx, t, srv, url, "1")
+	preserved := openBackChannel(ctx, t, srv, url, "2")
+	for _, sid := range []string{"1", "2"} {
+		if err := sm.session(sid).Send([]byte(`"a"`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Session 3 has no back channel, so its stop is not delivered and the
+	// Shutdown lasts until its (shortened) StopTimeout.
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	for !srv.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if code, _ := create(t, url, "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("create during shutdown status %d, want 503", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+
+	if b := <-stopped; !strings.Contains(b, `[1,"a"]`) ||
+		!strings.Contains(b, `[2,["stop"]]`) {
+		t.Errorf("back channel %q, want \"a\" and stop", b)
+	}
+	if b := <-preserved; !strings.Contains(b, `[1,"a"]`) ||
+		strings.Contains(b, "stop") {
+		t.Errorf("preserved back channel %q, want \"a\" and no stop", b)
+	}
+	for i := 0; i < 2; i++ {
+		if reason := <-sm.terminated; reason != ServerShutdownTermination {
+			t.Errorf("TerminatedSession reason = %v", reason)
+		}
+	}
+	select {
+	case reason := <-sm.terminated:
+		t.Errorf("preserved session terminated (%v)", reason)
+	default:
+	}
+	if sids := srv.SessionIDs(); len(sids) != 0 {
+		t.Errorf("SessionIDs = %v after Shutdown", sids)
+	}
+}
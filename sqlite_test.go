@@ -0,0 +1,27 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build sqlite
+
+// These tests require github.com/mattn/go-sqlite3: go test -tags sqlite
+
+package wc
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB opens an empty in-memory SQLite database.
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to :memory: is a separate database.
+	db.SetMaxOpenConns(1)
+	return db
+}
@@ -0,0 +1,396 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sqlSchema is created by SQLSessionManager.CreateTables(). Types are
+// accepted by SQLite and MySQL; other databases may create equivalent tables
+// directly.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS wc_session (
+		sid VARCHAR(64) NOT NULL PRIMARY KEY,
+		back_channel_aid INTEGER NOT NULL,
+		forward_channel_aid INTEGER NOT NULL,
+		next_back_channel_id INTEGER NOT NULL,
+		terminated INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS wc_back_channel (
+		sid VARCHAR(64) NOT NULL,
+		id INTEGER NOT NULL,
+		body BLOB NOT NULL,
+		PRIMARY KEY (sid, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS wc_forward_channel (
+		sid VARCHAR(64) NOT NULL,
+		id INTEGER NOT NULL,
+		body BLOB NOT NULL,
+		PRIMARY KEY (sid, id)
+	)`,
+}
+
+// SQLSessionManager is a SessionManager which stores sessions, their back
+// channel queue and their forward channel queue in SQL tables (see
+// CreateTables) through database/sql. Since all session state is in the
+// database, any server sharing the database can resume a session via
+// LookupSession().
+//
+// Forward channel messages are committed to the wc_forward_channel table
+// before they are ACKed to the client. Application code consumes them with
+// SQLSession.ForwardChannelPeek() and ForwardChannelACKThrough(). A terminated
+// session is kept (though it can no longer be resumed) until its forward
+// channel queue has been consumed.
+type SQLSessionManager struct {
+	DefaultSessionManager
+
+	// AuthFunc, if set, implements Session.Authenticated(). When nil all
+	// requests are considered authenticated.
+	AuthFunc func(s *SQLSession, r *http.Request) bool
+
+	// ForwardChannelNotify, if set, is invoked once forward channel messages
+	// have been committed.
+	ForwardChannelNotify func(s *SQLSession)
+
+	// NumberedPlaceholders uses $1, $2, ... rather than ? as query
+	// placeholders (eg: for PostgreSQL).
+	NumberedPlaceholders bool
+
+	db *sql.DB
+}
+
+// NewSQLSessionManager creates a SQLSessionManager storing sessions in db.
+func NewSQLSessionManager(db *sql.DB) *SQLSessionManager {
+	return &SQLSessionManager{db: db}
+}
+
+// DB returns the database used by the SQLSessionManager.
+func (sm *SQLSessionManager) DB() *sql.DB {
+	return sm.db
+}
+
+// CreateTables creates the session tables if they do not already exist.
+func (sm *SQLSessionManager) CreateTables() error {
+	for _, stmt := range sqlSchema {
+		if _, err := sm.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query rewrites the ? placeholders of q as required by the database.
+func (sm *SQLSessionManager) query(q string) string {
+	if !sm.NumberedPlaceholders {
+		return q
+	}
+	buf := new(strings.Builder)
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// transaction runs f within a transaction, committing if it returns nil.
+func (sm *SQLSessionManager) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sm *SQLSessionManager) newSQLSession(sid string) *SQLSession {
+	s := &SQLSession{sm: sm}
+	s.queuedSession = newQueuedSession(sid, s.BackChannelAdd)
+	s.AuthFunc = func(r *http.Request) bool {
+		return sm.AuthFunc == nil || sm.AuthFunc(s, r)
+	}
+	return s
+}
+
+// NewSession creates a session with a random SID.
+func (sm *SQLSessionManager) NewSession(r *http.Request) (Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	sid := hex.EncodeToString(b)
+	_, err := sm.db.Exec(sm.query(`INSERT INTO wc_session
+		(sid, back_channel_aid, forward_channel_aid, next_back_channel_id,
+		terminated) VALUES (?, -1, -1, 0, 0)`), sid)
+	if err != nil {
+		return nil, err
+	}
+	return sm.newSQLSession(sid), nil
+}
+
+// lookup returns the stored session sid and whether it has been terminated.
+func (sm *SQLSessionManager) lookup(sid string) (
+	*SQLSession,
+	*SessionInfo,
+	bool,
+	error,
+) {
+	si := &SessionInfo{}
+	var terminated int
+	err := sm.db.QueryRow(sm.query(`SELECT back_channel_aid, forward_channel_aid,
+		terminated FROM wc_session WHERE sid = ?`), sid).Scan(
+		&si.BackChannelAID, &si.ForwardChannelAID, &terminated)
+	if err == sql.ErrNoRows {
+		return nil, nil, false, ErrUnknownSID
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return sm.newSQLSession(sid), si, terminated != 0, nil
+}
+
+// LookupSession resumes a session stored in the database. ErrUnknownSID is
+// returned for terminated sessions.
+func (sm *SQLSessionManager) LookupSession(r *http.Request, sid string) (
+	Session,
+	*SessionInfo,
+	error,
+) {
+	s, si, terminated, err := sm.lookup(sid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if terminated {
+		return nil, nil, ErrUnknownSID
+	}
+	return s, si, nil
+}
+
+// Session returns the stored session sid (without resuming it in a Server),
+// allowing any server to add back channel messages or consume forward channel
+// messages. The Done() channel of a terminated session is closed.
+// ErrUnknownSID is returned if the session does not exist.
+func (sm *SQLSessionManager) Session(sid string) (*SQLSession, error) {
+	s, _, terminated, err := sm.lookup(sid)
+	if err != nil {
+		return nil, err
+	}
+	if terminated {
+		s.Close()
+	}
+	return s, nil
+}
+
+// TerminatedSession deletes the back channel queue of the session. Forward
+// channel messages which have not been ACKed through
+// SQLSession.ForwardChannelACKThrough() are kept, along with the session, so
+// that they are not lost.
+func (sm *SQLSessionManager) TerminatedSession(
+	s Session,
+	reason TerminationReason,
+) error {
+	return sm.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(sm.query(
+			"DELETE FROM wc_back_channel WHERE sid = ?"), s.SID())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sm.query(
+			"UPDATE wc_session SET terminated = 1 WHERE sid = ?"), s.SID())
+		if err != nil {
+			return err
+		}
+		return sm.removeTerminated(tx, s.SID())
+	})
+}
+
+// removeTerminated deletes session sid if it has been terminated and its
+// forward channel queue is empty.
+func (sm *SQLSessionManager) removeTerminated(tx *sql.Tx, sid string) error {
+	var id int
+	err := tx.QueryRow(sm.query(
+		"SELECT id FROM wc_forward_channel WHERE sid = ?"), sid).Scan(&id)
+	if err == nil {
+		// Messages remain to be consumed.
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = tx.Exec(sm.query(
+		"DELETE FROM wc_session WHERE sid = ? AND terminated = 1"), sid)
+	return err
+}
+
+// SQLSession is the Session implementation of SQLSessionManager. Its
+// AuthFunc invokes SQLSessionManager.AuthFunc (if set).
+//
+// Send() must only be used with sessions served by this Server. Use
+// BackChannelAdd() with sessions returned by SQLSessionManager.Session(); the
+// messages are delivered once the server holding the session next flushes
+// its back channel.
+type SQLSession struct {
+	queuedSession
+	sm *SQLSessionManager
+}
+
+// peek returns the messages queued in table in ID order.
+func (s *SQLSession) peek(table string) ([]*Message, error) {
+	rows, err := s.sm.db.Query(s.sm.query(
+		"SELECT id, body FROM "+table+" WHERE sid = ? ORDER BY id"), s.SID())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := []*Message{}
+	for rows.Next() {
+		msg := &Message{}
+		if err := rows.Scan(&msg.ID, &msg.Body); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// BackChannelPeek returns the un-ACKed back channel messages in ID order.
+func (s *SQLSession) BackChannelPeek() ([]*Message, error) {
+	return s.peek("wc_back_channel")
+}
+
+// BackChannelACKThrough removes all messages up to and including ID from the
+// back channel queue and records ID as the back channel AID.
+func (s *SQLSession) BackChannelACKThrough(ID int) error {
+	return s.sm.transaction(func(tx *sql.Tx) error {
+		var nextID int
+		err := tx.QueryRow(s.sm.query(
+			"SELECT next_back_channel_id FROM wc_session WHERE sid = ?"),
+			s.SID()).Scan(&nextID)
+		if err == sql.ErrNoRows {
+			return ErrUnknownSID
+		}
+		if err != nil {
+			return err
+		}
+		if ID >= nextID {
+			return fmt.Errorf("wc: ACK of unsent message %d", ID)
+		}
+		_, err = tx.Exec(s.sm.query(
+			"DELETE FROM wc_back_channel WHERE sid = ? AND id <= ?"), s.SID(), ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.sm.query(
+			"UPDATE wc_session SET back_channel_aid = ? WHERE sid = ?"),
+			ID, s.SID())
+		return err
+	})
+}
+
+// BackChannelAdd appends messageBody to the back channel queue using the next
+// message ID. It does not signal DataNotifier(); use Send() from application
+// code. ErrUnknownSID is returned once the session has been terminated.
+func (s *SQLSession) BackChannelAdd(messageBody []byte) error {
+	return s.sm.transaction(func(tx *sql.Tx) error {
+		// Increment first so that the row is locked for the transaction.
+		res, err := tx.Exec(s.sm.query(`UPDATE wc_session
+			SET next_back_channel_id = next_back_channel_id + 1
+			WHERE sid = ? AND terminated = 0`), s.SID())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrUnknownSID
+		}
+		var nextID int
+		err = tx.QueryRow(s.sm.query(
+			"SELECT next_back_channel_id FROM wc_session WHERE sid = ?"),
+			s.SID()).Scan(&nextID)
+		if err != nil {
+			return err
+		}
+		if messageBody == nil {
+			messageBody = []byte{}
+		}
+		_, err = tx.Exec(s.sm.query(
+			"INSERT INTO wc_back_channel (sid, id, body) VALUES (?, ?, ?)"),
+			s.SID(), nextID-1, messageBody)
+		return err
+	})
+}
+
+// ForwardChannel adds msgs to the forward channel queue and records the last
+// received ID in a single transaction.
+func (s *SQLSession) ForwardChannel(msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	err := s.sm.transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(s.sm.query(
+			"UPDATE wc_session SET forward_channel_aid = ? WHERE sid = ?"),
+			msgs[len(msgs)-1].ID, s.SID())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrUnknownSID
+		}
+		for _, msg := range msgs {
+			body := msg.Body
+			if body == nil {
+				body = []byte{}
+			}
+			_, err := tx.Exec(s.sm.query(
+				"INSERT INTO wc_forward_channel (sid, id, body) VALUES (?, ?, ?)"),
+				s.SID(), msg.ID, body)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if s.sm.ForwardChannelNotify != nil {
+		s.sm.ForwardChannelNotify(s)
+	}
+	return nil
+}
+
+// ForwardChannelPeek returns the unprocessed forward channel messages in ID
+// order.
+func (s *SQLSession) ForwardChannelPeek() ([]*Message, error) {
+	return s.peek("wc_forward_channel")
+}
+
+// ForwardChannelACKThrough removes all processed forward channel messages up
+// to and including ID. A terminated session is deleted once all of its
+// forward channel messages have been removed.
+func (s *SQLSession) ForwardChannelACKThrough(ID int) error {
+	return s.sm.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.sm.query(
+			"DELETE FROM wc_forward_channel WHERE sid = ? AND id <= ?"),
+			s.SID(), ID)
+		if err != nil {
+			return err
+		}
+		return s.sm.removeTerminated(tx, s.SID())
+	})
+}
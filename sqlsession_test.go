@@ -0,0 +1,140 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The tests run against fakeDB, or SQLite with the sqlite build tag (see
+// sqlite_test.go).
+func newTestSQLSessionManager(t *testing.T) *SQLSessionManager {
+	db := openTestDB(t)
+	t.Cleanup(func() { db.Close() })
+	sm := NewSQLSessionManager(db)
+	if err := sm.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+func TestSQLSessionBackChannel(t *testing.T) {
+	sm := newTestSQLSessionManager(t)
+	session, err := sm.NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := session.(*SQLSession)
+	for _, body := range []string{`["c"]`, `["a"]`, `["b"]`} {
+		if err := s.BackChannelAdd([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BackChannelACKThrough(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BackChannelACKThrough(3); err == nil {
+		t.Error("ACK of unsent message succeeded")
+	}
+
+	_, si, err := sm.LookupSession(nil, s.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SessionInfo{0, -1}); *si != want {
+		t.Errorf("SessionInfo = %+v, want %+v", *si, want)
+	}
+	msgs, err := s.BackChannelPeek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(msgs), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IDs = %v, want %v", got, want)
+	}
+	if string(msgs[0].Body) != `["a"]` {
+		t.Errorf("Body = %s, want [\"a\"]", msgs[0].Body)
+	}
+}
+
+func TestSQLSessionForwardChannel(t *testing.T) {
+	sm := newTestSQLSessionManager(t)
+	notified := 0
+	sm.ForwardChannelNotify = func(s *SQLSession) { notified++ }
+	session, err := sm.NewSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := session.(*SQLSession)
+	msgs := []*Message{
+		NewMessage(0, []byte(`{"a":"1"}`)),
+		NewMessage(1, []byte(`{"b":"2"}`)),
+	}
+	if err := s.ForwardChannel(msgs); err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate ID fails the whole batch.
+	err = s.ForwardChannel([]*Message{
+		NewMessage(2, []byte(`{}`)),
+		NewMessage(1, []byte(`{}`)),
+	})
+	if err == nil {
+		t.Fatal("duplicate forward channel message succeeded")
+	}
+	if notified != 1 {
+		t.Errorf("ForwardChannelNotify invoked %d times, want 1", notified)
+	}
+
+	other, err := sm.Session(s.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.ForwardChannelPeek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msgs) {
+		t.Errorf("ForwardChannelPeek = %v, want %v", got, msgs)
+	}
+	_, si, err := sm.LookupSession(nil, s.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.ForwardChannelAID != 1 {
+		t.Errorf("ForwardChannelAID = %d, want 1", si.ForwardChannelAID)
+	}
+	if err := other.ForwardChannelACKThrough(0); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = other.ForwardChannelPeek()
+	if ids := messageIDs(got); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("IDs after ACK = %v, want [1]", ids)
+	}
+
+	// The unprocessed forward channel message outlives the session.
+	if err := sm.TerminatedSession(s, ClientTerminateRequest); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.LookupSession(nil, s.SID()); err != ErrUnknownSID {
+		t.Errorf("LookupSession after termination error = %v", err)
+	}
+	other, err = sm.Session(s.SID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = other.ForwardChannelPeek()
+	if ids := messageIDs(got); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("IDs after termination = %v, want [1]", ids)
+	}
+	if err := other.Send([]byte(`"a"`)); err != ErrSessionTerminated {
+		t.Errorf("Send after termination error = %v", err)
+	}
+	if err := other.ForwardChannelACKThrough(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Session(s.SID()); err != ErrUnknownSID {
+		t.Errorf("Session after ACK error = %v, want ErrUnknownSID", err)
+	}
+}
@@ -15,12 +15,12 @@ const (
 	testDelay       = 2
 )
 
-func testPhase1(p *padder) {
+func testPhase1(p *padder, hostPrefix string) {
 	p.t = none
-	p.write(jsonArray([]interface{}{sm.HostPrefix()}))
+	p.write(jsonArray([]interface{}{hostPrefix}))
 }
 
-func testPhase2(p *padder) {
+func testPhase2(p *padder, r *http.Request) {
 	if p.t == length {
 		p.t = none
 	}
@@ -28,12 +28,8 @@ func testPhase2(p *padder) {
 	if err != nil {
 		return
 	}
-	var closeNotify <-chan bool
-	if cn, ok := p.w.(http.CloseNotifier); ok {
-		closeNotify = cn.CloseNotify()
-	}
 	select {
-	case <-closeNotify:
+	case <-r.Context().Done():
 		// shortcut the second test chunk
 	case <-time.After(testDelay * time.Second):
 		p.chunk(testSecondChunk)
@@ -43,15 +39,12 @@ func testPhase2(p *padder) {
 
 // TestHandler handles WebChannel and BrowserChannel test requests. When using
 // the defaults this hanlder should be installed at "/channel/test".
-func TestHandler(w http.ResponseWriter, r *http.Request) {
-	if sm == nil {
-		panic("No SessionManager provided")
-	}
+func (s *Server) TestHandler(w http.ResponseWriter, r *http.Request) {
 	p := newPadder(w, r)
 	switch r.FormValue("MODE") {
 	case "init":
-		testPhase1(p)
+		testPhase1(p, s.sm.HostPrefix())
 	default:
-		testPhase2(p)
+		testPhase2(p, r)
 	}
 }
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import "fmt"
+
+// Subscribe adds the session sid to topic. Subsequent calls to Publish(topic)
+// queue messages on the session's back channel until the session is
+// unsubscribed or terminated. ErrUnknownSID is returned if sid is not an
+// active session of this Server; in particular a session cannot subscribe
+// from within SessionManager.NewSession() (use
+// Session.BackChannelNewSessionMessages() instead).
+func (s *Server) Subscribe(sid, topic string) error {
+	sw, ok := s.sessions.get(sid)
+	if !ok {
+		return ErrUnknownSID
+	}
+
+	s.topicMutex.Lock()
+	defer s.topicMutex.Unlock()
+	select {
+	case <-sw.done:
+		return ErrSessionTerminated
+	default:
+	}
+	subscribers, ok := s.topics[topic]
+	if !ok {
+		subscribers = make(map[*sessionWrapper]struct{})
+		s.topics[topic] = subscribers
+	}
+	subscribers[sw] = struct{}{}
+	sw.topics[topic] = struct{}{}
+	return nil
+}
+
+// Unsubscribe removes the session sid from topic.
+func (s *Server) Unsubscribe(sid, topic string) error {
+	sw, ok := s.sessions.get(sid)
+	if !ok {
+		return ErrUnknownSID
+	}
+
+	s.topicMutex.Lock()
+	defer s.topicMutex.Unlock()
+	s.unsubscribe(sw, topic)
+	return nil
+}
+
+// unsubscribe removes sw from topic. s.topicMutex must be held.
+func (s *Server) unsubscribe(sw *sessionWrapper, topic string) {
+	delete(sw.topics, topic)
+	subscribers := s.topics[topic]
+	delete(subscribers, sw)
+	if len(subscribers) == 0 {
+		delete(s.topics, topic)
+	}
+}
+
+// unsubscribeAll removes sw from all of its topics.
+func (s *Server) unsubscribeAll(sw *sessionWrapper) {
+	s.topicMutex.Lock()
+	defer s.topicMutex.Unlock()
+	for topic := range sw.topics {
+		s.unsubscribe(sw, topic)
+	}
+}
+
+// Publish queues messageBody on the back channel of every session subscribed
+// to topic and returns the number of sessions. messageBody is shared between
+// the sessions, so it must be encoded once by the caller and not modified
+// afterwards. Publish does not block on the sessions; each session adds the
+// queued messages (via BackChannelAdd) and flushes its back channel once,
+// however many messages were published in the meantime.
+func (s *Server) Publish(topic string, messageBody []byte) int {
+	s.topicMutex.RLock()
+	defer s.topicMutex.RUnlock()
+	subscribers := s.topics[topic]
+	for sw := range subscribers {
+		sw.publishMutex.Lock()
+		sw.published = append(sw.published, messageBody)
+		sw.publishMutex.Unlock()
+		select {
+		case sw.publishNotifier <- struct{}{}:
+		default:
+			// A notification is already pending.
+		}
+	}
+	return len(subscribers)
+}
+
+// publish is invoked from sessionWorker to add published messages to the
+// back channel.
+func publish(sw *sessionWrapper) {
+	sw.publishMutex.Lock()
+	published := sw.published
+	sw.published = nil
+	sw.publishMutex.Unlock()
+
+	// A message which can not be added is lost, but does not prevent the
+	// remaining messages from being added.
+	queued := 0
+	var err error
+	for _, body := range published {
+		if aerr := sw.BackChannelAdd(body); aerr != nil {
+			err = aerr
+			continue
+		}
+		sw.backChannelBytes += len(body)
+		queued++
+	}
+	if err != nil {
+		sw.srv.sm.Error(sw.request(), fmt.Errorf(
+			"wc: %d of %d published messages lost: %v",
+			len(published)-queued, len(published), err))
+	}
+	sw.debug(sw.request(), "wc: published messages", "count", queued)
+	if sw.bc != nil {
+		if err := flushPending(sw); err != nil {
+			sw.srv.sm.Error(sw.bc.r, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitBackChannel waits for the back channel of s to contain want.
+func waitBackChannel(t *testing.T, s Session, want []string) {
+	var got []string
+	for i := 0; i < 100; i++ {
+		msgs, err := s.BackChannelPeek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = []string{}
+		for _, msg := range msgs {
+			got = append(got, string(msg.Body))
+		}
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%s back channel = %v, want %v", s.SID(), got, want)
+}
+
+func TestPublish(t *testing.T) {
+	srv := NewServer(&testSessionManager{}, nil)
+	sessions := []*sessionWrapper{}
+	for i := 0; i < 3; i++ {
+		sw, err := srv.newSession(httptest.NewRequest("POST", "/bind", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, sw)
+	}
+	for _, sw := range sessions[:2] {
+		if err := srv.Subscribe(sw.SID(), "room"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.Subscribe("unknown", "room"); err != ErrUnknownSID {
+		t.Errorf("Subscribe(unknown) = %v, want ErrUnknownSID", err)
+	}
+
+	if n := srv.Publish("room", []byte(`["a"]`)); n != 2 {
+		t.Errorf("Publish = %d, want 2", n)
+	}
+	if err := srv.Unsubscribe(sessions[1].SID(), "room"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Publish("room", []byte(`["b"]`)); n != 1 {
+		t.Errorf("Publish = %d, want 1", n)
+	}
+	waitBackChannel(t, sessions[0], []string{`["a"]`, `["b"]`})
+	waitBackChannel(t, sessions[1], []string{`["a"]`})
+	waitBackChannel(t, sessions[2], []string{})
+
+	if err := srv.Unsubscribe(sessions[0].SID(), "room"); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.topics) != 0 {
+		t.Errorf("topics = %v, want none", srv.topics)
+	}
+}
+
+// rejectSession fails to add the back channel message ["bad"].
+type rejectSession struct {
+	*MemorySession
+}
+
+func (s rejectSession) BackChannelAdd(messageBody []byte) error {
+	if string(messageBody) == `["bad"]` {
+		return errors.New("rejected")
+	}
+	return s.MemorySession.BackChannelAdd(messageBody)
+}
+
+// errorSessionManager records the errors passed to Error.
+type errorSessionManager struct {
+	testSessionManager
+	mutex  sync.Mutex
+	errors []error
+}
+
+func (sm *errorSessionManager) Error(r *http.Request, err error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.errors = append(sm.errors, err)
+}
+
+func TestPublishError(t *testing.T) {
+	sm := &errorSessionManager{}
+	srv := NewServer(sm, nil)
+	s := rejectSession{NewMemorySession("1", nil)}
+	sw := newSessionWrapper(srv, s)
+	sw.published = [][]byte{[]byte(`["a"]`), []byte(`["bad"]`),
+		[]byte(`["c"]`)}
+	publish(sw)
+
+	// The messages after the rejected one are still queued.
+	waitBackChannel(t, s, []string{`["a"]`, `["c"]`})
+	if len(sm.errors) != 1 ||
+		!strings.Contains(sm.errors[0].Error(), "1 of 3") {
+		t.Errorf("errors = %v, want 1 of 3 messages lost", sm.errors)
+	}
+}
@@ -9,19 +9,25 @@
 package wc
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 )
 
-// TODO(hochhaus): OSID, OAID session restarts
-
 var (
 	// ErrUnknownSID is the error to be returned when the requested SID is not
 	// known to the server.
 	ErrUnknownSID = errors.New("wc: Unknown SID")
 
-	sm SessionManager
+	// ErrSessionTerminated is returned when notifying a session which wc has
+	// already terminated.
+	ErrSessionTerminated = errors.New("wc: Session terminated")
+
+	// ErrServerShutdown is the error returned when a session is requested from
+	// a Server which is shutting down.
+	ErrServerShutdown = errors.New("wc: Server shutting down")
 )
 
 // SessionActivity sends notifications from application level code to the wc
@@ -34,12 +40,18 @@ const (
 	// out of the web application, or terminating a session out from under an
 	// active user when their account is deleted.
 	//
+	// A "stop" message is queued on the back channel via BackChannelAdd() and
+	// delivered on the current (or next) back channel. The session is
+	// terminated once the stop has been written to a back channel (or ACKed
+	// by the client), or after Options.StopTimeout.
+	//
 	// It is the responsibility of the application level code to send
-	// ServerTerminate notifications when active sessions should be timed out.
-	// Failure to do so will cause leaking Session objects and the goroutines
-	// processing those sessions. Additionally, it is the responsibility of the
-	// application level code to cleanup old sessions which are no longer used
-	// but might be retained in persistent storage (such as a message queue).
+	// ServerTerminate notifications when active sessions should be timed out,
+	// unless Options.IdleTimeout is set. Failure to do so will cause leaking
+	// Session objects and the goroutines processing those sessions.
+	// Additionally, it is the responsibility of the application level code to
+	// cleanup old sessions which are no longer used but might be retained in
+	// persistent storage (such as a message queue).
 	// Such session "leakage" can happen, for example, when the server crashes
 	// and a session which was previously being processed (and would have been
 	// timed-out) it not used again after the application restarts.
@@ -58,6 +70,20 @@ const (
 	// the termination of the SID by sending a ServerTerminate event to the
 	// Session Notifier().
 	ServerTerminateRequest
+
+	// SessionRestartTermination denotes the client replacing the SID with a
+	// new session (by supplying OSID and OAID when creating the new session).
+	// Un-ACKed back channel messages are moved to the new session prior to
+	// termination.
+	SessionRestartTermination
+
+	// IdleTimeoutTermination denotes the session being terminated by wc after
+	// a period of inactivity (see Options.IdleTimeout).
+	IdleTimeoutTermination
+
+	// ServerShutdownTermination denotes the session being terminated by
+	// Server.Shutdown() (see ShutdownPreserver).
+	ServerShutdownTermination
 )
 
 // Message describes a single forward or backchannel message.
@@ -75,6 +101,12 @@ func NewMessage(ID int, Body []byte) *Message {
 // with an individual WebChannel session. This is used to both modify the
 // Session and receive events from it. Only a single method will be invoked
 // per session at a time.
+//
+// If the Session also implements io.Closer, Close() is invoked once the
+// session has been terminated and wc has stopped processing it. Sends on
+// Notifier() and DataNotifier() are then received and discarded for one
+// minute, after which they are no longer received (DefaultSession.Notify()
+// and NotifyData() do not block once the session has been closed).
 type Session interface {
 	SID() string
 
@@ -95,6 +127,8 @@ type Session interface {
 	// each time new BackChannel data arrives. Writes to this session will not
 	// block so it is safe to write to this channel even from inside the
 	// session's go routine (for example from the ForwardChannel() callback).
+	// Once the session has been terminated writes are no longer received (see
+	// DefaultSession.NotifyData).
 	DataNotifier() chan int
 
 	// BackChannelNewSessionMessages allows insertion of messages into the back
@@ -149,16 +183,40 @@ type SessionInfo struct {
 
 // DefaultSession provides a partial implementation of the Session interface.
 // Callers must implement at least Authenticated(), BackChannel(),
-// AckBackChannelThrough(), BackChannelAdd() and ForwardChannel().
+// AckBackChannelThrough(), BackChannelAdd() and ForwardChannel(). The zero
+// value is ready to use.
 type DefaultSession struct {
 	SessionID    string
+	initOnce     sync.Once
 	notifier     chan SessionActivity
 	dataNotifier chan int
+	done         chan struct{}
+	closeOnce    sync.Once
 }
 
 // NewDefaultSession initializes a DefaultSession object with the specified ID.
 func NewDefaultSession(sid string) *DefaultSession {
-	return &DefaultSession{sid, make(chan SessionActivity), make(chan int)}
+	return &DefaultSession{
+		SessionID:    sid,
+		notifier:     make(chan SessionActivity),
+		dataNotifier: make(chan int),
+		done:         make(chan struct{}),
+	}
+}
+
+// init creates the chans of a zero value DefaultSession.
+func (s *DefaultSession) init() {
+	s.initOnce.Do(func() {
+		if s.notifier == nil {
+			s.notifier = make(chan SessionActivity)
+		}
+		if s.dataNotifier == nil {
+			s.dataNotifier = make(chan int)
+		}
+		if s.done == nil {
+			s.done = make(chan struct{})
+		}
+	})
 }
 
 // SID return the SessionID field.
@@ -168,14 +226,57 @@ func (s *DefaultSession) SID() string {
 
 // Notifier returns the DefaultSession notifier chan.
 func (s *DefaultSession) Notifier() chan SessionActivity {
+	s.init()
 	return s.notifier
 }
 
 // DataNotifier returns the DefaultSession notifier chan.
 func (s *DefaultSession) DataNotifier() chan int {
+	s.init()
 	return s.dataNotifier
 }
 
+// Notify sends sa to the Notifier chan. ErrSessionTerminated is returned
+// (rather than blocking forever) once the session has been terminated.
+func (s *DefaultSession) Notify(sa SessionActivity) error {
+	s.init()
+	select {
+	case s.notifier <- sa:
+		return nil
+	case <-s.done:
+		return ErrSessionTerminated
+	}
+}
+
+// NotifyData sends byteCount to the DataNotifier chan. ErrSessionTerminated
+// is returned (rather than blocking forever) once the session has been
+// terminated.
+func (s *DefaultSession) NotifyData(byteCount int) error {
+	s.init()
+	select {
+	case s.dataNotifier <- byteCount:
+		return nil
+	case <-s.done:
+		return ErrSessionTerminated
+	}
+}
+
+// Done returns a chan which is closed once the session has been terminated.
+func (s *DefaultSession) Done() <-chan struct{} {
+	s.init()
+	return s.done
+}
+
+// Close marks the session as terminated. It is invoked by wc and is safe to
+// call multiple times.
+func (s *DefaultSession) Close() error {
+	s.init()
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
 // BackChannelNewSessionMessages provides a noop implementation.
 func (s *DefaultSession) BackChannelNewSessionMessages() error {
 	return nil
@@ -215,11 +316,14 @@ type SessionManager interface {
 	// by the client or server).
 	TerminatedSession(s Session, reason TerminationReason) error
 
-	// Error logs internal failure conditions to application level code.
+	// Error logs internal failure conditions to application level code. r is
+	// nil when the failure is not associated with an HTTP request.
 	Error(r *http.Request, err error)
 
 	// Debug logs internal wc debugging messages. This is most useful to
 	// developers of wc.
+	//
+	// Deprecated: wc no longer calls Debug; it logs to Options.Logger.
 	Debug(string)
 
 	// HostPrefix is used to circumvent same host connection limits.
@@ -239,6 +343,9 @@ type SessionManager interface {
 // SessionManager interface. Callers must implement at least NewSession() and
 // TerminatedSession().
 type DefaultSessionManager struct {
+	// Logger receives the errors passed to Error(). When nil, slog.Default()
+	// is used.
+	Logger *slog.Logger
 }
 
 // LookupSession provides a noop implementation. All sessions requested are
@@ -252,12 +359,27 @@ func (sm *DefaultSessionManager) LookupSession(r *http.Request, sid string) (
 	return nil, nil, ErrUnknownSID
 }
 
-// Error logs to stderr.
+// Error logs err at slog.LevelError to Logger (or slog.Default() when
+// Logger is nil). When r is set its context is passed to the slog.Handler,
+// correlating the error with the application's request logging.
 func (sm *DefaultSessionManager) Error(r *http.Request, err error) {
-	log.Print(err.Error())
+	logger := sm.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ctx := context.Background()
+	args := []any{slog.String("error", err.Error())}
+	if r != nil {
+		ctx = r.Context()
+		args = append(args, slog.String("method", r.Method),
+			slog.String("path", r.URL.Path))
+	}
+	logger.ErrorContext(ctx, "wc: error", args...)
 }
 
 // Debug discards debugging messages.
+//
+// Deprecated: wc no longer calls Debug; it logs to Options.Logger.
 func (sm *DefaultSessionManager) Debug(debug string) {
 }
 
@@ -265,12 +387,3 @@ func (sm *DefaultSessionManager) Debug(debug string) {
 func (sm *DefaultSessionManager) HostPrefix() string {
 	return ""
 }
-
-// SetSessionManager allows the calling code to inject a custom application
-// specific SessionManager implementation.
-func SetSessionManager(sessionMgr SessionManager) {
-	if sm != nil {
-		panic("SessionManager already specified")
-	}
-	sm = sessionMgr
-}
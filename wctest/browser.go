@@ -0,0 +1,448 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wctest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0"
+	"gopkg.in/samegoal/wc.v0/internal/wire"
+)
+
+// ForwardReply is the server's reply to a forward channel request.
+type ForwardReply struct {
+	// BackChannel reports whether the session had an open back channel.
+	BackChannel bool
+	// LastAID is the ID of the last back channel message sent.
+	LastAID int
+	// OutstandingBytes is the size of the un-ACKed back channel messages.
+	OutstandingBytes int
+}
+
+// Browser is a scripted WebChannel client. Unlike wc.Client it does nothing
+// implicitly: back channels are opened, dropped and reconnected only when
+// requested, with the AID of the caller's choosing. Failures are reported
+// with t.Fatalf, so Browser methods must be called from the test goroutine.
+type Browser struct {
+	t      testing.TB
+	srv    *Server
+	header http.Header
+
+	sid    string
+	aid    int
+	nextID int
+	rid    int
+
+	// bc is the open back channel, if any.
+	bc *browserBackChannel
+	// msgs receives the messages of all back channels, in order.
+	msgs chan *wc.Message
+}
+
+// browserBackChannel is a back channel request read by its own goroutine.
+type browserBackChannel struct {
+	cancel context.CancelFunc
+	// err is the reason the back channel ended (io.EOF when closed by the
+	// server), valid once done is closed.
+	err  error
+	done chan struct{}
+}
+
+// Open creates a session, failing t on error. The create message is
+// consumed; the back channel is not opened.
+func (s *Server) Open(t testing.TB) *Browser {
+	t.Helper()
+	return s.open(t, nil, url.Values{}, http.StatusOK)
+}
+
+// OpenHeader is like Open, but header is sent with each of the Browser's
+// requests.
+func (s *Server) OpenHeader(t testing.TB, header http.Header) *Browser {
+	t.Helper()
+	return s.open(t, header, url.Values{}, http.StatusOK)
+}
+
+// Restart creates a new session replacing b, as a client does when it
+// reconnects after losing its session, sending header with each of the new
+// Browser's requests. The server carries over the back channel messages of b
+// after AID() to the new session and terminates b.
+func (b *Browser) Restart(header http.Header) *Browser {
+	b.t.Helper()
+	return b.srv.open(b.t, header, b.restartQuery(), http.StatusOK)
+}
+
+// ExpectRestartForbidden attempts to restart b as Restart does, failing
+// unless the server refuses the request as not authenticated for b.
+func (b *Browser) ExpectRestartForbidden(header http.Header) {
+	b.t.Helper()
+	b.srv.open(b.t, header, b.restartQuery(), http.StatusForbidden)
+}
+
+func (b *Browser) restartQuery() url.Values {
+	return url.Values{"OSID": {b.sid}, "OAID": {strconv.Itoa(b.aid)}}
+}
+
+// open creates a session with the create request parameters query, failing
+// t unless the response has status code. Messages following the create
+// message in the response are received as if from a back channel.
+func (s *Server) open(
+	t testing.TB,
+	header http.Header,
+	query url.Values,
+	code int,
+) *Browser {
+	t.Helper()
+	b := &Browser{
+		t:      t,
+		srv:    s,
+		header: header,
+		aid:    -1,
+		msgs:   make(chan *wc.Message, 1024),
+	}
+	query.Set("CVER", "8")
+	query.Set("RID", b.nextRID())
+	resp := b.do("POST", query, url.Values{"count": {"0"}}, code)
+	defer resp.Body.Close()
+	if code != http.StatusOK {
+		return nil
+	}
+	chunk, err := wire.ReadChunk(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatalf("wctest: reading create response: %v", err)
+	}
+	msgs, err := wire.DecodeMessages(chunk)
+	if err != nil {
+		t.Fatalf("wctest: %v", err)
+	}
+	var create []interface{}
+	if len(msgs) == 0 || json.Unmarshal(msgs[0].Body, &create) != nil ||
+		len(create) < 2 || create[0] != "c" {
+		t.Fatalf("wctest: create response %s has no create message", chunk)
+	}
+	b.sid, _ = create[1].(string)
+	b.aid = msgs[0].ID
+	for _, msg := range msgs[1:] {
+		b.msgs <- wc.NewMessage(msg.ID, msg.Body)
+	}
+	return b
+}
+
+// SID returns the session ID.
+func (b *Browser) SID() string {
+	return b.sid
+}
+
+// AID returns the ID of the last back channel message received.
+func (b *Browser) AID() int {
+	return b.aid
+}
+
+func (b *Browser) nextRID() string {
+	b.rid++
+	return strconv.Itoa(b.rid)
+}
+
+// request creates a request to BindHandler.
+func (b *Browser) request(
+	ctx context.Context,
+	method string,
+	query url.Values,
+	form url.Values,
+) *http.Request {
+	b.t.Helper()
+	query.Set("VER", "8")
+	if b.sid != "" {
+		query.Set("SID", b.sid)
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r, err := http.NewRequestWithContext(ctx, method,
+		b.srv.ChannelURL+"/bind?"+query.Encode(), body)
+	if err != nil {
+		b.t.Fatalf("wctest: %v", err)
+	}
+	for key, values := range b.header {
+		r.Header[key] = values
+	}
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+// do performs a request, failing unless the response has status code.
+func (b *Browser) do(
+	method string,
+	query url.Values,
+	form url.Values,
+	code int,
+) *http.Response {
+	b.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), b.srv.Timeout)
+	resp, err := b.srv.Client().Do(b.request(ctx, method, query, form))
+	if err != nil {
+		cancel()
+		b.t.Fatalf("wctest: %s %s: %v", method, query.Get("TYPE"), err)
+	}
+	if resp.StatusCode != code {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		b.t.Fatalf("wctest: status %d (%s), want %d", resp.StatusCode,
+			strings.TrimSpace(string(body)), code)
+	}
+	// Release the context once the body has been read.
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelBody) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// Send delivers msgs on the forward channel, ACKing the back channel through
+// AID(), and returns the server's reply.
+func (b *Browser) Send(msgs ...map[string]string) ForwardReply {
+	b.t.Helper()
+	form := url.Values{
+		"count": {strconv.Itoa(len(msgs))},
+		"ofs":   {strconv.Itoa(b.nextID)},
+	}
+	for i, msg := range msgs {
+		for key, value := range msg {
+			form.Set(fmt.Sprintf("req%d_%s", i, key), value)
+		}
+	}
+	query := url.Values{"RID": {b.nextRID()}, "AID": {strconv.Itoa(b.aid)}}
+	resp := b.do("POST", query, form, http.StatusOK)
+	defer resp.Body.Close()
+	chunk, err := wire.ReadChunk(bufio.NewReader(resp.Body))
+	if err != nil {
+		b.t.Fatalf("wctest: reading forward channel response: %v", err)
+	}
+	var reply []interface{}
+	if err := json.Unmarshal(chunk, &reply); err != nil || len(reply) != 3 {
+		b.t.Fatalf("wctest: invalid forward channel response %s", chunk)
+	}
+	b.nextID += len(msgs)
+	open, _ := reply[0].(bool)
+	lastAID, _ := reply[1].(float64)
+	bytes, _ := reply[2].(float64)
+	return ForwardReply{open, int(lastAID), int(bytes)}
+}
+
+// ExpectUnknownSID sends an empty forward channel request and fails unless
+// the server responds 'Unknown SID'.
+func (b *Browser) ExpectUnknownSID() {
+	b.t.Helper()
+	query := url.Values{"RID": {b.nextRID()}, "AID": {strconv.Itoa(b.aid)}}
+	resp := b.do("POST", query, url.Values{"count": {"0"}},
+		http.StatusBadRequest)
+	resp.Body.Close()
+}
+
+// OpenBackChannel opens a streaming back channel, ACKing through AID().
+func (b *Browser) OpenBackChannel() {
+	b.t.Helper()
+	b.OpenBackChannelAt(b.aid)
+}
+
+// OpenBackChannelAt opens a streaming back channel which ACKs through aid.
+// An aid older than AID() simulates a client which missed messages, and the
+// server should retransmit them. Any back channel already open is dropped
+// first.
+func (b *Browser) OpenBackChannelAt(aid int) {
+	b.t.Helper()
+	b.DropBackChannel()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := b.request(ctx, "GET", url.Values{
+		"RID":  {"rpc"},
+		"AID":  {strconv.Itoa(aid)},
+		"TYPE": {"xmlhttp"},
+		"CI":   {"0"},
+	}, nil)
+	bc := &browserBackChannel{cancel: cancel, done: make(chan struct{})}
+	b.bc = bc
+	go bc.read(ctx, b.srv.Client(), r, b.msgs)
+
+	// The response headers are not sent until there is data, so wait for
+	// the server to register the back channel.
+	timeout := time.After(b.srv.Timeout)
+	for {
+		status, err := b.srv.WC.SessionStatus(ctx, b.sid)
+		if err == nil && status.BackChannel {
+			return
+		}
+		select {
+		case <-bc.done:
+			b.bc = nil
+			b.t.Fatalf("wctest: opening back channel: %v", bc.err)
+		case <-timeout:
+			b.t.Fatalf("wctest: back channel not opened")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (bc *browserBackChannel) read(
+	ctx context.Context,
+	hc *http.Client,
+	r *http.Request,
+	msgs chan *wc.Message,
+) {
+	defer close(bc.done)
+	resp, err := hc.Do(r)
+	if err != nil {
+		bc.err = err
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		bc.err = fmt.Errorf("status %d (%s)", resp.StatusCode,
+			strings.TrimSpace(string(body)))
+		return
+	}
+	br := bufio.NewReader(resp.Body)
+	for {
+		chunk, err := wire.ReadChunk(br)
+		if err != nil {
+			bc.err = err
+			return
+		}
+		decoded, err := wire.DecodeMessages(chunk)
+		if err != nil {
+			bc.err = err
+			return
+		}
+		for _, msg := range decoded {
+			select {
+			case msgs <- wc.NewMessage(msg.ID, msg.Body):
+			case <-ctx.Done():
+				bc.err = ctx.Err()
+				return
+			}
+		}
+	}
+}
+
+// DropBackChannel abruptly closes the back channel (if open) from the client
+// side, as a network failure would, and waits for the server to notice.
+func (b *Browser) DropBackChannel() {
+	b.t.Helper()
+	if b.bc == nil {
+		return
+	}
+	b.bc.cancel()
+	<-b.bc.done
+	b.bc = nil
+
+	ctx := context.Background()
+	timeout := time.After(b.srv.Timeout)
+	for {
+		status, err := b.srv.WC.SessionStatus(ctx, b.sid)
+		if err != nil || !status.BackChannel {
+			return
+		}
+		select {
+		case <-timeout:
+			b.t.Fatalf("wctest: dropped back channel not closed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// ExpectBackChannelClosed waits for the server to close the back channel.
+func (b *Browser) ExpectBackChannelClosed() {
+	b.t.Helper()
+	if b.bc == nil {
+		b.t.Fatalf("wctest: no back channel open")
+	}
+	select {
+	case <-b.bc.done:
+	case <-time.After(b.srv.Timeout):
+		b.t.Fatalf("wctest: back channel not closed")
+	}
+	if b.bc.err != io.EOF {
+		b.t.Fatalf("wctest: back channel failed: %v", b.bc.err)
+	}
+	b.bc.cancel()
+	b.bc = nil
+}
+
+// Receive returns the next back channel message, including noop and stop
+// messages. AID() is advanced past it.
+func (b *Browser) Receive() *wc.Message {
+	b.t.Helper()
+	select {
+	case msg := <-b.msgs:
+		if msg.ID > b.aid {
+			b.aid = msg.ID
+		}
+		return msg
+	case <-time.After(b.srv.Timeout):
+		b.t.Fatalf("wctest: no back channel message received")
+	}
+	return nil
+}
+
+// Expect receives back channel messages, skipping noops, and fails unless
+// their bodies are bodies (in order). The stop message is `["stop"]`.
+func (b *Browser) Expect(bodies ...string) {
+	b.t.Helper()
+	for _, want := range bodies {
+		msg := b.Receive()
+		for string(msg.Body) == `["noop"]` {
+			msg = b.Receive()
+		}
+		if string(msg.Body) != want {
+			b.t.Fatalf("wctest: received %d %s, want %s", msg.ID, msg.Body, want)
+		}
+	}
+}
+
+// ExpectNothing fails if a message other than a noop is received within d.
+func (b *Browser) ExpectNothing(d time.Duration) {
+	b.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case msg := <-b.msgs:
+			if string(msg.Body) != `["noop"]` {
+				b.t.Fatalf("wctest: unexpected message %d %s", msg.ID, msg.Body)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Terminate drops the back channel and asks the server to terminate the
+// session.
+func (b *Browser) Terminate() {
+	b.t.Helper()
+	b.DropBackChannel()
+	query := url.Values{"RID": {b.nextRID()}, "TYPE": {"terminate"}}
+	resp := b.do("GET", query, nil, http.StatusOK)
+	resp.Body.Close()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wctest
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"gopkg.in/samegoal/wc.v0"
+)
+
+// EchoSessionManager creates wc.MemorySessions which send each forward
+// channel message body back on the back channel. SIDs are sequential,
+// starting at "1".
+type EchoSessionManager struct {
+	wc.DefaultSessionManager
+
+	mutex    sync.Mutex
+	next     int
+	sessions map[string]*wc.MemorySession
+}
+
+// NewSession creates an echoing MemorySession.
+func (sm *EchoSessionManager) NewSession(r *http.Request) (wc.Session, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.next++
+	s := wc.NewMemorySession(strconv.Itoa(sm.next), echo)
+	if sm.sessions == nil {
+		sm.sessions = make(map[string]*wc.MemorySession)
+	}
+	sm.sessions[s.SID()] = s
+	return s, nil
+}
+
+// Session returns the active session sid, or nil.
+func (sm *EchoSessionManager) Session(sid string) *wc.MemorySession {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.sessions[sid]
+}
+
+// TerminatedSession forgets s.
+func (sm *EchoSessionManager) TerminatedSession(
+	s wc.Session,
+	reason wc.TerminationReason,
+) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	delete(sm.sessions, s.SID())
+	return nil
+}
+
+func echo(s *wc.MemorySession, msgs []*wc.Message) error {
+	for _, msg := range msgs {
+		if err := s.Send(msg.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wctest provides utilities for end-to-end testing of WebChannel
+// applications. Server runs a wc.Server on an httptest.Server and records the
+// SessionManager callbacks it makes. Browser drives a scripted client session
+// over the real wire protocol, including the failure cases (dropped back
+// channels, reconnects with stale AIDs) which are awkward to reproduce with a
+// browser.
+//
+// A typical test:
+//
+//	srv := wctest.NewServer(mySessionManager, nil)
+//	defer srv.Close()
+//	b := srv.Open(t)
+//	b.OpenBackChannel()
+//	b.Send(map[string]string{"msg": "hello"})
+//	b.Expect(`{"msg":"hello"}`)
+//	b.Terminate()
+//	srv.ExpectEvent(t, wctest.Event{
+//		Type:   wctest.TerminatedSession,
+//		SID:    b.SID(),
+//		Reason: wc.ClientTerminateRequest,
+//	})
+package wctest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0"
+)
+
+// DefaultTimeout is the default Server.Timeout.
+const DefaultTimeout = 5 * time.Second
+
+// Server is a wc.Server listening on a local httptest.Server. TestHandler is
+// installed at /channel/test and BindHandler at /channel/bind.
+type Server struct {
+	*httptest.Server
+
+	// WC is the server under test.
+	WC *wc.Server
+
+	// ChannelURL is the URL of the channel, as passed to wc.Dial().
+	ChannelURL string
+
+	// Timeout limits each wait for a message or event. The default is
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	recorder *recorder
+}
+
+// NewServer starts a Server for sm. The Server must be closed with Close().
+func NewServer(sm wc.SessionManager, opts *wc.Options) *Server {
+	rec := &recorder{SessionManager: sm, notify: make(chan struct{})}
+	s := &Server{
+		WC:       wc.NewServer(rec, opts),
+		Timeout:  DefaultTimeout,
+		recorder: rec,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channel/test", s.WC.TestHandler)
+	mux.HandleFunc("/channel/bind", s.WC.BindHandler)
+	s.Server = httptest.NewServer(mux)
+	s.ChannelURL = s.URL + "/channel"
+	return s
+}
+
+// Close shuts down the wc.Server (terminating its sessions, which ends their
+// back channels) and then the httptest.Server.
+func (s *Server) Close() {
+	// The short deadline limits both the spreading out of back channel closes
+	// and the wait for stop messages to sessions without a back channel.
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	s.WC.Shutdown(ctx)
+	s.Server.Close()
+}
+
+// closeTimeout is the deadline of the wc.Server shutdown in Close.
+const closeTimeout = 200 * time.Millisecond
+
+// EventType identifies a SessionManager callback.
+type EventType int
+
+const (
+	// NewSession records a call to NewSession.
+	NewSession EventType = iota
+	// LookupSession records a call to LookupSession.
+	LookupSession
+	// TerminatedSession records a call to TerminatedSession.
+	TerminatedSession
+	// Error records a call to Error.
+	Error
+)
+
+func (t EventType) String() string {
+	switch t {
+	case NewSession:
+		return "NewSession"
+	case LookupSession:
+		return "LookupSession"
+	case TerminatedSession:
+		return "TerminatedSession"
+	case Error:
+		return "Error"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a SessionManager callback made by the Server.
+type Event struct {
+	Type EventType
+	// SID is the session, when known.
+	SID string
+	// Reason is set for TerminatedSession.
+	Reason wc.TerminationReason
+	// Err is the error returned by NewSession or LookupSession, or passed to
+	// Error.
+	Err error
+}
+
+// Events returns the events recorded so far.
+func (s *Server) Events() []Event {
+	return s.recorder.events()
+}
+
+// ExpectEvent waits for an event equal to want (ignoring Err, which is only
+// compared for nil-ness) and fails the test if none is recorded within
+// Timeout.
+func (s *Server) ExpectEvent(t testing.TB, want Event) {
+	t.Helper()
+	match := func(e Event) bool {
+		return e.Type == want.Type && e.SID == want.SID &&
+			e.Reason == want.Reason && (e.Err == nil) == (want.Err == nil)
+	}
+	timeout := time.After(s.Timeout)
+	for {
+		notify := s.recorder.changed()
+		for _, e := range s.Events() {
+			if match(e) {
+				return
+			}
+		}
+		select {
+		case <-notify:
+		case <-timeout:
+			t.Fatalf("wctest: no event %+v in %+v", want, s.Events())
+		}
+	}
+}
+
+// recorder is a SessionManager which records the callbacks made to the
+// SessionManager it wraps.
+type recorder struct {
+	wc.SessionManager
+
+	mutex sync.Mutex
+	log   []Event
+	// notify is closed and replaced when an event is recorded.
+	notify chan struct{}
+}
+
+func (rec *recorder) record(e Event) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.log = append(rec.log, e)
+	close(rec.notify)
+	rec.notify = make(chan struct{})
+}
+
+func (rec *recorder) events() []Event {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return append([]Event{}, rec.log...)
+}
+
+// changed returns a chan which is closed when the next event is recorded.
+func (rec *recorder) changed() <-chan struct{} {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.notify
+}
+
+func (rec *recorder) NewSession(r *http.Request) (wc.Session, error) {
+	s, err := rec.SessionManager.NewSession(r)
+	e := Event{Type: NewSession, Err: err}
+	if err == nil {
+		e.SID = s.SID()
+	}
+	rec.record(e)
+	return s, err
+}
+
+func (rec *recorder) LookupSession(r *http.Request, sid string) (
+	wc.Session,
+	*wc.SessionInfo,
+	error,
+) {
+	s, si, err := rec.SessionManager.LookupSession(r, sid)
+	rec.record(Event{Type: LookupSession, SID: sid, Err: err})
+	return s, si, err
+}
+
+func (rec *recorder) TerminatedSession(
+	s wc.Session,
+	reason wc.TerminationReason,
+) error {
+	rec.record(Event{Type: TerminatedSession, SID: s.SID(), Reason: reason})
+	return rec.SessionManager.TerminatedSession(s, reason)
+}
+
+func (rec *recorder) Error(r *http.Request, err error) {
+	rec.record(Event{Type: Error, Err: err})
+	rec.SessionManager.Error(r, err)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wctest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/samegoal/wc.v0"
+)
+
+func TestEcho(t *testing.T) {
+	srv := NewServer(&EchoSessionManager{}, nil)
+	defer srv.Close()
+
+	b := srv.Open(t)
+	srv.ExpectEvent(t, Event{Type: NewSession, SID: b.SID()})
+	b.OpenBackChannel()
+	reply := b.Send(map[string]string{"a": "1"}, map[string]string{"b": "2"})
+	if !reply.BackChannel {
+		t.Errorf("Send = %+v, want BackChannel", reply)
+	}
+	b.Expect(`{"a":"1"}`, `{"b":"2"}`)
+
+	b.Terminate()
+	srv.ExpectEvent(t, Event{
+		Type:   TerminatedSession,
+		SID:    b.SID(),
+		Reason: wc.ClientTerminateRequest,
+	})
+	b.ExpectUnknownSID()
+}
+
+func TestReconnectStaleAID(t *testing.T) {
+	srv := NewServer(&EchoSessionManager{}, nil)
+	defer srv.Close()
+
+	b := srv.Open(t)
+	created := b.AID()
+	b.OpenBackChannel()
+	b.Send(map[string]string{"a": "1"})
+	b.Send(map[string]string{"b": "2"})
+	b.Expect(`{"a":"1"}`, `{"b":"2"}`)
+
+	// Neither message has been ACKed, so both are retransmitted.
+	b.DropBackChannel()
+	b.OpenBackChannelAt(created)
+	b.Expect(`{"a":"1"}`, `{"b":"2"}`)
+
+	// Reconnecting with the current AID ACKs them.
+	b.OpenBackChannel()
+	b.ExpectNothing(100 * time.Millisecond)
+	b.Send(map[string]string{"c": "3"})
+	b.Expect(`{"c":"3"}`)
+}
+
+func TestServerTerminate(t *testing.T) {
+	srv := NewServer(&EchoSessionManager{}, nil)
+	defer srv.Close()
+
+	b := srv.Open(t)
+	b.OpenBackChannel()
+	b.Send()
+	ctx := context.Background()
+	if err := srv.WC.TerminateSession(ctx, b.SID()); err != nil {
+		t.Fatal(err)
+	}
+	b.Expect(`["stop"]`)
+	b.ExpectBackChannelClosed()
+	srv.ExpectEvent(t, Event{
+		Type:   TerminatedSession,
+		SID:    b.SID(),
+		Reason: wc.ServerTerminateRequest,
+	})
+
+	// The SID is not known to LookupSession either.
+	b.ExpectUnknownSID()
+	srv.ExpectEvent(t, Event{
+		Type: LookupSession,
+		SID:  b.SID(),
+		Err:  wc.ErrUnknownSID,
+	})
+}
+
+func TestNoop(t *testing.T) {
+	srv := NewServer(&EchoSessionManager{},
+		&wc.Options{NoopInterval: 20 * time.Millisecond})
+	defer srv.Close()
+
+	b := srv.Open(t)
+	b.OpenBackChannel()
+	if msg := b.Receive(); string(msg.Body) != `["noop"]` {
+		t.Errorf("Receive = %s, want noop", msg.Body)
+	}
+}
+
+// userSessionManager creates echoing sessions which are only authenticated
+// for requests with the X-User header of the request creating them.
+type userSessionManager struct {
+	*EchoSessionManager
+}
+
+func (sm userSessionManager) NewSession(r *http.Request) (wc.Session, error) {
+	s, err := sm.EchoSessionManager.NewSession(r)
+	if err != nil {
+		return nil, err
+	}
+	user := r.Header.Get("X-User")
+	s.(*wc.MemorySession).AuthFunc = func(r *http.Request) bool {
+		return r.Header.Get("X-User") == user
+	}
+	return s, nil
+}
+
+func TestRestart(t *testing.T) {
+	sm := &EchoSessionManager{}
+	srv := NewServer(userSessionManager{sm}, nil)
+	defer srv.Close()
+
+	alice := http.Header{"X-User": {"alice"}}
+	b := srv.OpenHeader(t, alice)
+	b.OpenBackChannel()
+	b.Send(map[string]string{"a": "1"})
+	b.Expect(`{"a":"1"}`)
+	b.DropBackChannel()
+	if err := sm.Session(b.SID()).Send([]byte(`"missed"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the message sent after AID() is carried over.
+	r := b.Restart(alice)
+	srv.ExpectEvent(t, Event{
+		Type:   TerminatedSession,
+		SID:    b.SID(),
+		Reason: wc.SessionRestartTermination,
+	})
+	r.Expect(`"missed"`)
+	r.OpenBackChannel()
+	r.ExpectNothing(100 * time.Millisecond)
+	r.Send(map[string]string{"b": "2"})
+	r.Expect(`{"b":"2"}`)
+	b.ExpectUnknownSID()
+}
+
+func TestRestartHijack(t *testing.T) {
+	sm := &EchoSessionManager{}
+	srv := NewServer(userSessionManager{sm}, nil)
+	defer srv.Close()
+
+	alice := http.Header{"X-User": {"alice"}}
+	b := srv.OpenHeader(t, alice)
+	if err := sm.Session(b.SID()).Send([]byte(`"secret"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another user can not take over the session (or its messages).
+	b.ExpectRestartForbidden(http.Header{"X-User": {"mallory"}})
+	b.OpenBackChannel()
+	b.Expect(`"secret"`)
+	b.Send(map[string]string{"a": "1"})
+	b.Expect(`{"a":"1"}`)
+	for _, e := range srv.Events() {
+		if e.Type == TerminatedSession {
+			t.Errorf("session %s terminated (%v)", e.SID, e.Reason)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 1 << 20
+	// wsMaxControlSize is the largest payload of a control frame.
+	wsMaxControlSize = 125
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+	wsCloseInternalError = 1011
+	// wsCloseServiceRestart asks the client to reconnect (RFC 6455 section
+	// 11.7 registry).
+	wsCloseServiceRestart = 1012
+)
+
+var (
+	errWSProtocol = errors.New("wc: WebSocket protocol error")
+	errWSTooBig   = errors.New("wc: WebSocket message too large")
+)
+
+// OriginChecker may optionally be implemented by a SessionManager to decide
+// which origins may open WebSockets with Server.WebSocketHandler. Browsers
+// send cookies with cross-site WebSocket handshakes, so without a check any
+// site could open a session using the user's credentials.
+type OriginChecker interface {
+	// CheckOrigin reports whether the WebSocket handshake r (whose Origin
+	// header is set) is allowed.
+	CheckOrigin(r *http.Request) bool
+}
+
+// checkOrigin reports whether the WebSocket handshake r may proceed. Requests
+// without an Origin header (which are not made by browsers) are allowed.
+// Unless the SessionManager implements OriginChecker, the Origin must be the
+// host the request was sent to.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if oc, ok := s.sm.(OriginChecker); ok {
+		return oc.CheckOrigin(r)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsConn implements the subset of RFC 6455 needed to carry WebChannel
+// traffic. Reads are performed by a single goroutine (wsReader). Writes may
+// come from both the session worker and wsReader (control frames) and are
+// serialized by mutex.
+type wsConn struct {
+	conn   net.Conn
+	brw    *bufio.ReadWriter
+	mutex  sync.Mutex
+	closed chan struct{}
+	// readTimeout limits the wait for each frame from the client. The server
+	// pings the client with each noop, which the client answers with a pong.
+	readTimeout time.Duration
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, v := range header[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return r.Method == "GET" &&
+		headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket") &&
+		r.Header.Get("Sec-WebSocket-Version") == "13" &&
+		r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (
+	*wsConn,
+	error,
+) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) +
+		"\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, brw: brw, closed: make(chan struct{})}, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	header := []byte{0x80 | opcode}
+	switch l := len(payload); {
+	case l < 126:
+		header = append(header, byte(l))
+	case l <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+	if _, err := c.brw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.brw.Write(payload); err != nil {
+		return err
+	}
+	return c.brw.Flush()
+}
+
+func (c *wsConn) writeClose(code int) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(wsClose, payload)
+}
+
+// readFrame reads a single client frame, unmasking the payload.
+func (c *wsConn) readFrame() (
+	fin bool,
+	opcode byte,
+	payload []byte,
+	err error,
+) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	var header [2]byte
+	if _, err = io.ReadFull(c.brw, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		// Reserved bits set or unmasked client frame.
+		err = errWSProtocol
+		return
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.brw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.brw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode&0x8 != 0 && (!fin || length > wsMaxControlSize) {
+		// Control frames must not be fragmented and are limited to 125 bytes.
+		err = errWSProtocol
+		return
+	}
+	if length > wsMaxMessageSize {
+		err = errWSTooBig
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.brw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.brw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// readMessage returns the next complete data message, transparently
+// answering control frames.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeClose(wsCloseNormal)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, errWSProtocol
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errWSProtocol
+			}
+		default:
+			return nil, errWSProtocol
+		}
+		if len(msg)+len(payload) > wsMaxMessageSize {
+			return nil, errWSTooBig
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// wsResponseWriter adapts a wsConn to the http.ResponseWriter and
+// http.Flusher interfaces used by padder. Each Flush() sends the data written
+// since the previous Flush() as a single text message. When a message cannot
+// be sent the connection is closed (ending the back channel) and the error is
+// returned by subsequent writes.
+type wsResponseWriter struct {
+	c      *wsConn
+	header http.Header
+	buf    bytes.Buffer
+	err    error
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(b)
+}
+
+func (w *wsResponseWriter) WriteHeader(int) {
+}
+
+func (w *wsResponseWriter) Flush() {
+	if w.buf.Len() == 0 || w.err != nil {
+		return
+	}
+	if err := w.c.writeFrame(wsText, w.buf.Bytes()); err != nil {
+		w.err = err
+		w.c.conn.Close()
+	}
+	w.buf.Reset()
+}
+
+type wsMessage struct {
+	bc   *reqRegister
+	form url.Values
+}
+
+func wsReader(sw *sessionWrapper, bc *reqRegister, c *wsConn) {
+	defer close(c.closed)
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			switch err {
+			case errWSProtocol:
+				c.writeClose(wsCloseProtocolError)
+			case errWSTooBig:
+				c.writeClose(wsCloseTooBig)
+			}
+			return
+		}
+		form, err := url.ParseQuery(string(msg))
+		if err != nil {
+			sw.srv.sm.Error(bc.r, err)
+			c.writeClose(wsCloseProtocolError)
+			return
+		}
+		select {
+		case sw.wsNotifier <- &wsMessage{bc, form}:
+		case <-bc.done:
+			return
+		case <-sw.done:
+			return
+		}
+	}
+}
+
+// webSocket installs a newly upgraded WebSocket as the session's back
+// channel. It is invoked from sessionWorker.
+func webSocket(sw *sessionWrapper, reqRequest *reqRegister) {
+	newSession := reqRequest.r.FormValue("SID") == ""
+	sw.debug(reqRequest.r, "wc: new WebSocket", "new_session", newSession)
+	if newSession {
+		createMsg := []byte(jsonArray(
+			[]interface{}{"c", sw.SID(), sw.srv.sm.HostPrefix(), 8},
+		))
+		if _, err := sw.addInternal(createMsg); err != nil {
+			sw.srv.sm.Error(reqRequest.r, err)
+			http.Error(reqRequest.w, "Unable to add create message to back channel",
+				http.StatusInternalServerError)
+			close(reqRequest.done)
+			return
+		}
+		if err := carryOverMessages(sw, reqRequest.r); err != nil {
+			sw.srv.sm.Error(reqRequest.r, err)
+			writeRestartError(reqRequest.w, err)
+			close(reqRequest.done)
+			return
+		}
+		if err := sw.BackChannelNewSessionMessages(); err != nil {
+			sw.srv.sm.Error(reqRequest.r, err)
+			http.Error(reqRequest.w, "Unable to add messages for new session",
+				http.StatusInternalServerError)
+			close(reqRequest.done)
+			return
+		}
+		msgs, err := sw.BackChannelPeek()
+		if err != nil {
+			sw.srv.sm.Error(reqRequest.r, err)
+			http.Error(reqRequest.w, "Unable to get messages",
+				http.StatusInternalServerError)
+			close(reqRequest.done)
+			return
+		}
+		sw.backChannelBytes = messageBytes(msgs)
+	} else if !maybeACKBackChannel(sw, reqRequest.w, reqRequest.r, false) {
+		close(reqRequest.done)
+		return
+	}
+
+	c, err := upgradeWebSocket(reqRequest.w, reqRequest.r)
+	if err != nil {
+		sw.srv.sm.Error(reqRequest.r, err)
+		http.Error(reqRequest.w, "Unable to upgrade to WebSocket",
+			http.StatusInternalServerError)
+		close(reqRequest.done)
+		return
+	}
+	c.readTimeout = 2 * sw.options.NoopInterval
+	reqRequest.ws = c
+
+	if sw.bc != nil {
+		sw.BackChannelClose()
+		sw.srv.sm.Error(reqRequest.r, errors.New("Duplicate backchannel."))
+		close(sw.bc.done)
+	}
+	if sw.bc == nil {
+		sw.srv.metric(MetricBackChannels, 1)
+	}
+	sw.bc = reqRequest
+	w := &wsResponseWriter{c: c, header: make(http.Header)}
+	sw.p = &padder{w: w, f: w, t: none}
+	sw.backChannelCloseNotifier = c.closed
+	// The WebSocket is kept alive by noops; it is not subject to the long
+	// back channel limit.
+	sw.resetNoopTimer()
+	sw.BackChannelOpen()
+	go wsReader(sw, reqRequest, c)
+	if err := flushPending(sw); err != nil {
+		sw.srv.sm.Error(sw.bc.r, err)
+	}
+}
+
+// wsForwardChannel processes a forward channel message received on the
+// WebSocket. It is invoked from sessionWorker.
+func wsForwardChannel(sw *sessionWrapper, m *wsMessage) {
+	if m.bc != sw.bc {
+		// The WebSocket has already been replaced or closed.
+		return
+	}
+	c := m.bc.ws
+	fail := func(code int, err error) {
+		sw.srv.sm.Error(m.bc.r, err)
+		c.writeClose(code)
+		c.conn.Close()
+	}
+
+	if aid := m.form.Get("AID"); aid != "" {
+		id, err := strconv.Atoi(aid)
+		if err != nil || id < 0 {
+			fail(wsCloseProtocolError, errors.New("wc: Unable to parse AID"))
+			return
+		}
+		if _, err := ackBackChannel(sw, id, true); err != nil {
+			fail(wsCloseInternalError, err)
+			return
+		}
+	}
+
+	msgs, err := forwardMessages(sw, m.form)
+	if err != nil {
+		fail(wsCloseProtocolError, err)
+		return
+	}
+	if err := deliverForward(sw, msgs); err != nil {
+		fail(wsCloseInternalError, err)
+		return
+	}
+
+	reply := []interface{}{
+		true,
+		sw.si.BackChannelAID,
+		sw.backChannelBytes,
+	}
+	if err := sw.p.chunk(jsonArray(reply)); err != nil {
+		fail(wsCloseInternalError, err)
+	}
+}
+
+// WebSocketHandler handles WebChannel sessions carried over a WebSocket. The
+// WebSocket acts as both the forward and back channel of the session, and the
+// Session and SessionManager interfaces are used exactly as with BindHandler.
+//
+// The client connects with the same query parameters as a back channel
+// request (SID and AID, both omitted for a new session). Each text message
+// sent by the server is either a JSON array of [ID, body] pairs, as written
+// on a back channel, or the reply to a forward channel message, as written in
+// response to a forward channel request. Each message sent by the client is a
+// URL encoded forward channel request body (count, ofs, reqN_key and,
+// optionally, AID).
+//
+// Handshakes from another origin are refused with 403 Forbidden unless the
+// SessionManager implements OriginChecker. The client must answer the ping
+// sent with each noop (as browsers do automatically), otherwise the
+// WebSocket is closed after twice the NoopInterval without a frame.
+func (s *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !isWebSocketRequest(r) {
+		http.Error(w, "Not a WebSocket handshake", 400)
+		return
+	}
+	if !s.checkOrigin(r) {
+		s.sm.Error(r, errors.New("wc: WebSocket origin not allowed"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	sw := s.session(w, r)
+	if sw == nil {
+		return
+	}
+	rr := newReqRegister(w, r)
+	rr.webSocket = true
+	if !s.dispatch(sw, rr) {
+		return
+	}
+	<-rr.done
+	if rr.ws != nil {
+		rr.ws.conn.Close()
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2014 SameGoal LLC. All Rights Reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal WebSocket client which writes raw frames.
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// newWebSocketTestServer serves WebSocketHandler of a Server for sm at /ws,
+// returning the URL of the handler.
+func newWebSocketTestServer(
+	t *testing.T,
+	sm SessionManager,
+	opts *Options,
+) (*Server, string) {
+	srv := NewServer(sm, opts)
+	hs := httptest.NewServer(http.HandlerFunc(srv.WebSocketHandler))
+	t.Cleanup(hs.Close)
+	return srv, hs.URL + "/ws"
+}
+
+// dialWebSocket performs the handshake with rawurl (an http URL), returning
+// the response and, for 101 Switching Protocols, the client.
+func dialWebSocket(t *testing.T, rawurl string, header http.Header) (
+	*wsTestClient,
+	*http.Response,
+) {
+	t.Helper()
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, resp
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &wsTestClient{t: t, conn: conn, br: br}, resp
+}
+
+// writeFrame writes a single frame, masked unless unmasked is set.
+func (c *wsTestClient) writeFrame(
+	fin bool,
+	opcode byte,
+	payload []byte,
+	unmasked bool,
+) {
+	c.t.Helper()
+	frame := wsTestFrame(fin, opcode, payload, unmasked)
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// wsTestFrame encodes a client frame.
+func wsTestFrame(
+	fin bool,
+	opcode byte,
+	payload []byte,
+	unmasked bool,
+) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	maskBit := byte(0x80)
+	if unmasked {
+		maskBit = 0
+	}
+	switch l := len(payload); {
+	case l < 126:
+		b = append(b, maskBit|byte(l))
+	case l <= 0xffff:
+		b = append(b, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(l))
+	default:
+		b = append(b, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[2:], uint64(l))
+	}
+	if unmasked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	b = append(b, mask...)
+	for i, p := range payload {
+		b = append(b, p^mask[i%4])
+	}
+	return b
+}
+
+// readFrame reads a single (unmasked) server frame.
+func (c *wsTestClient) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		return 0, nil, errors.New("fragmented or masked server frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// expectText reads frames, skipping pings, until a text message is received
+// and fails unless it is want.
+func (c *wsTestClient) expectText(want string) {
+	c.t.Helper()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.t.Fatalf("reading %s: %v", want, err)
+		}
+		if opcode == wsPing {
+			continue
+		}
+		if opcode != wsText || string(payload) != want {
+			c.t.Fatalf("received %#x %q, want text %s", opcode, payload, want)
+		}
+		return
+	}
+}
+
+// expectClose reads frames, skipping pings, until a close frame with code is
+// received.
+func (c *wsTestClient) expectClose(code int) {
+	c.t.Helper()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.t.Fatalf("reading close: %v", err)
+		}
+		switch {
+		case opcode == wsPing || opcode == wsText:
+			continue
+		case opcode != wsClose || len(payload) < 2:
+			c.t.Fatalf("received %#x %q, want close", opcode, payload)
+		}
+		if got := int(binary.BigEndian.Uint16(payload)); got != code {
+			c.t.Errorf("close code %d, want %d", got, code)
+		}
+		return
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example from RFC 6455 section 1.3.
+	if got, want := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="),
+		"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("wsAccept = %s, want %s", got, want)
+	}
+}
+
+// originSessionManager allows WebSockets from a single origin.
+type originSessionManager struct {
+	testSessionManager
+	origin string
+}
+
+func (sm *originSessionManager) CheckOrigin(r *http.Request) bool {
+	return r.Header.Get("Origin") == sm.origin
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	_, wsURL := newWebSocketTestServer(t, &testSessionManager{}, nil)
+	host := strings.TrimSuffix(strings.TrimPrefix(wsURL, "http://"), "/ws")
+
+	tests := []struct {
+		header http.Header
+		code   int
+	}{
+		// Not a browser.
+		{http.Header{}, http.StatusSwitchingProtocols},
+		{http.Header{"Origin": {"http://" + host}},
+			http.StatusSwitchingProtocols},
+		// Cross-site WebSocket hijacking.
+		{http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+		{http.Header{"Origin": {"null"}}, http.StatusForbidden},
+		{http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusBadRequest},
+	}
+	sessions := 0
+	for _, test := range tests {
+		c, resp := dialWebSocket(t, wsURL, test.header)
+		if resp.StatusCode != test.code {
+			t.Errorf("%v: status %d, want %d", test.header, resp.StatusCode,
+				test.code)
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Accept"); got !=
+			"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("Sec-WebSocket-Accept = %q", got)
+		}
+		sessions++
+		c.expectText(`[[0,["c","` + strconv.Itoa(sessions) + `","",8]]]`)
+		c.conn.Close()
+	}
+
+	// An OriginChecker replaces the same origin check.
+	sm := &originSessionManager{origin: "https://app.example"}
+	_, wsURL = newWebSocketTestServer(t, sm, nil)
+	for origin, code := range map[string]int{
+		"https://app.example": http.StatusSwitchingProtocols,
+		"http://" + host:      http.StatusForbidden,
+	} {
+		c, resp := dialWebSocket(t, wsURL, http.Header{"Origin": {origin}})
+		if resp.StatusCode != code {
+			t.Errorf("Origin %s: status %d, want %d", origin, resp.StatusCode,
+				code)
+		}
+		if c != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+func TestWebSocketSession(t *testing.T) {
+	sm := &testSessionManager{forward: echo}
+	srv, wsURL := newWebSocketTestServer(t, sm, nil)
+	c, _ := dialWebSocket(t, wsURL, nil)
+	c.expectText(`[[0,["c","1","",8]]]`)
+
+	// A forward channel message fragmented across three frames, with a ping
+	// in between. The reply precedes the echoed message.
+	body := []byte("count=1&ofs=0&AID=0&req0_a=1")
+	c.writeFrame(false, wsText, body[:5], false)
+	c.writeFrame(true, wsPing, []byte("ping"), false)
+	c.writeFrame(false, wsContinuation, body[5:10], false)
+	c.writeFrame(true, wsContinuation, body[10:], false)
+	opcode, payload, err := c.readFrame()
+	if err != nil || opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("received %#x %q %v, want pong", opcode, payload, err)
+	}
+	c.expectText(`[true,0,0]`)
+	c.expectText(`[[1,{"a":"1"}]]`)
+
+	// A clean close.
+	c.writeFrame(true, wsClose, []byte{0x03, 0xe8}, false)
+	c.expectClose(wsCloseNormal)
+	if _, _, err := c.readFrame(); err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+
+	// Reconnecting with the previous AID retransmits the un-ACKed message, and
+	// already received forward channel messages are not redelivered.
+	c, _ = dialWebSocket(t, wsURL+"?SID=1&AID=0", nil)
+	c.expectText(`[[1,{"a":"1"}]]`)
+	c.writeFrame(true, wsText, []byte("count=2&ofs=0&AID=1&req0_a=1&req1_b=2"),
+		false)
+	c.expectText(`[true,1,0]`)
+	c.expectText(`[[2,{"b":"2"}]]`)
+	status, err := srv.SessionStatus(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.BackChannel || status.Transport != "websocket" ||
+		status.SessionInfo.ForwardChannelAID != 1 {
+		t.Errorf("SessionStatus = %+v", status)
+	}
+
+	// Protocol errors close the WebSocket.
+	c.writeFrame(true, wsText, []byte("x"), true)
+	c.expectClose(wsCloseProtocolError)
+}
+
+func TestWebSocketReadTimeout(t *testing.T) {
+	opts := &Options{NoopInterval: 20 * time.Millisecond}
+	_, wsURL := newWebSocketTestServer(t, &testSessionManager{}, opts)
+
+	// A client which answers pings stays connected.
+	c, _ := dialWebSocket(t, wsURL, nil)
+	pings := 0
+	for pings < 5 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatalf("after %d pings: %v", pings, err)
+		}
+		if opcode == wsPing {
+			pings++
+			c.writeFrame(true, wsPong, payload, false)
+		}
+	}
+
+	// A client which does not is disconnected.
+	c, _ = dialWebSocket(t, wsURL, nil)
+	start := time.Now()
+	for {
+		if _, _, err := c.readFrame(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("not disconnected after %v", time.Since(start))
+			}
+			break
+		}
+	}
+}
+
+func TestWebSocketReadFrame(t *testing.T) {
+	big := make([]byte, wsMaxMessageSize+1)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   error
+	}{
+		{"unmasked", [][]byte{wsTestFrame(true, wsText, nil, true)},
+			errWSProtocol},
+		{"reserved bits", [][]byte{{0xc1, 0x80, 0, 0, 0, 0}}, errWSProtocol},
+		{"fragmented ping", [][]byte{
+			wsTestFrame(false, wsText, []byte("a"), false),
+			wsTestFrame(false, wsPing, nil, false),
+		}, errWSProtocol},
+		{"fragmented close", [][]byte{wsTestFrame(false, wsClose, nil, false)},
+			errWSProtocol},
+		{"long ping", [][]byte{
+			wsTestFrame(true, wsPing, make([]byte, wsMaxControlSize+1), false),
+		}, errWSProtocol},
+		{"unexpected continuation", [][]byte{
+			wsTestFrame(true, wsContinuation, []byte("a"), false),
+		}, errWSProtocol},
+		{"interleaved message", [][]byte{
+			wsTestFrame(false, wsText, []byte("a"), false),
+			wsTestFrame(true, wsText, []byte("b"), false),
+		}, errWSProtocol},
+		{"unknown opcode", [][]byte{wsTestFrame(true, 0x3, nil, false)},
+			errWSProtocol},
+		{"too big", [][]byte{wsTestFrame(true, wsBinary, big, false)},
+			errWSTooBig},
+		{"too big fragmented", [][]byte{
+			wsTestFrame(false, wsText, big[:wsMaxMessageSize], false),
+			wsTestFrame(true, wsContinuation, []byte("a"), false),
+		}, errWSTooBig},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		c := &wsConn{
+			conn: server,
+			brw: bufio.NewReadWriter(bufio.NewReader(server),
+				bufio.NewWriter(server)),
+		}
+		go func() {
+			for _, frame := range test.frames {
+				if _, err := client.Write(frame); err != nil {
+					return
+				}
+			}
+		}()
+		if msg, err := c.readMessage(); err != test.want {
+			t.Errorf("%s: readMessage = %q %v, want %v", test.name, msg, err,
+				test.want)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	// Without data the read times out.
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &wsConn{
+		conn:        server,
+		brw:         bufio.NewReadWriter(bufio.NewReader(server), nil),
+		readTimeout: 10 * time.Millisecond,
+	}
+	if _, err := c.readMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("readMessage = %v, want deadline exceeded", err)
+	}
+	server.Close()
+}